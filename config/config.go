@@ -1,7 +1,12 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/yeka/zip"
@@ -13,24 +18,54 @@ type MainConfig struct {
 
 //Config is the config for initialize the service
 type Config struct {
-	Server ServerConfig
-	Log    LogConfig
-	Mqtt   MqttConfig
+	Server    ServerConfig
+	Log       LogConfig
+	Mqtt      MqttConfig
+	LocalMqtt LocalMqttConfig
+	Remote    []RemoteConfig //Remote is the list of remote destinations, [mqtt] is used when it is empty
 }
 
 //UserConfig is the config for user
 type UserConfig struct {
-	Server UserServerConfig
-	Mqtt   UserMqttConfig
+	Server    UserServerConfig
+	Mqtt      UserMqttConfig
+	LocalMqtt LocalMqttConfig
+	Remote    []RemoteConfig
 }
 
+const (
+	DefaultRemoteName              = "default"          //DefaultRemoteName is the name of the remote destination built from [mqtt]
+	RemoteTypeMqtt                 = "mqtt"             //RemoteTypeMqtt is the remote destination sending to a MQTT broker
+	RemoteTypeHTTP                 = "http"             //RemoteTypeHTTP is the remote destination posting to a HTTP(S) endpoint
+	FormatMsgpack                  = "msgpack"          //FormatMsgpack post the payload as received from local MQTT broker
+	FormatJSON                     = "json"             //FormatJSON post the payload converted to JSON
+	DefaultLocalMqttServers        = "127.0.0.1:1883"   //DefaultLocalMqttServers is the local MQTT broker when not configured
+	DefaultLocalMqttClientIDSuffix = "_DataSync"        //DefaultLocalMqttClientIDSuffix is appended to ClientID for local MQTT client
+	DefaultHTTPListen              = ":8080"            //DefaultHTTPListen is the address of the local HTTP API when not configured
+	DefaultOnlinePayload           = "Device + online." //DefaultOnlinePayload is published to WillTopic on connect when not configured
+	RedactedSecret                 = "******"           //RedactedSecret replaces passwords and tokens in the redacted config
+	DefaultBufferSize              = 1000               //DefaultBufferSize is the number of samples buffered in memory when not configured
+	BufferDropOldest               = "oldest"           //BufferDropOldest drop the oldest sample buffered when the buffer is full
+	BufferDropNewest               = "newest"           //BufferDropNewest drop the sample received when the buffer is full
+	DefaultRecoveryDevice          = "/dev/mmcblk0p1"   //DefaultRecoveryDevice is the device of MainFolder when not configured
+	DefaultRecoveryInterval        = 60                 //DefaultRecoveryInterval is the interval of retrying recovery in second when not configured
+)
+
+//DefaultRecoveryCommands repair the SD card when RecoveryCommands is not configured
+var DefaultRecoveryCommands = []string{"fsck.fat -a [Device]"}
+
 //UserServerConfig is the config for user to control basic raw data and pollutant data sending
 type UserServerConfig struct {
-	LogRaw            bool //LogRaw decide whether log raw data to local or not
-	LogPollutant      bool //LogPollutant decide whether log pollutant data to local or not
-	SendRawData       bool //SendRawData decide whether send raw data to server or not
-	SendPollutantData bool //SendPollutantData device whether send pollutant data to server or not
-	WaitTime          int  //WaitTime before the main process start running
+	LogRaw            bool   //LogRaw decide whether log raw data to local or not
+	LogPollutant      bool   //LogPollutant decide whether log pollutant data to local or not
+	SendRawData       bool   //SendRawData decide whether send raw data to server or not
+	SendPollutantData bool   //SendPollutantData device whether send pollutant data to server or not
+	WaitTime          int    //WaitTime before the main process start running
+	BufferSize        int    //BufferSize is the number of samples buffered in memory while the database is unavailable
+	BufferOverflow    string //BufferOverflow is the sample dropped when the buffer is full, oldest or newest
+	KeepMonths        int    //KeepMonths is the number of months of database files kept, including current month
+	KeepUnsentMonths  int    //KeepUnsentMonths is the number of months of database files with unsent data kept
+	MinFreeMB         int    //MinFreeMB is the free space of MainFolder in MB below which the oldest files are removed
 }
 
 //UserMqttConfig is the config for user to control MQTT related configuration
@@ -43,7 +78,10 @@ type UserMqttConfig struct {
 	PollutantTopic       string //Topic for sending pollutant data
 	ResendPollutantTopic string
 	ResendRawTopic       string
-	ResendingInterval    int //Sending Interval in second
+	ResendingInterval    int     //Sending Interval in second
+	ResendBatchSize      int     //Number of rows committed in one batch when resending
+	ResendRate           float64 //Maximum messages per second when resending
+	ResendByteRate       float64 //Maximum bytes per second when resending
 }
 
 //ServerConfig is the config for cloud server
@@ -55,6 +93,20 @@ type ServerConfig struct {
 	SendPollutantData bool   //SendPollutantData device whether send pollutant data to server or not
 	MainFolder        string //MainFolder is where database file is located
 	WaitTime          int
+	HTTPEnabled       bool   //HTTPEnabled start the local HTTP API (disabled by default)
+	HTTPListen        string //HTTPListen is the address the local HTTP API listens on
+	HTTPToken         string //HTTPToken is the bearer token required by the local HTTP API, no authorization when empty
+	BufferSize        int    //BufferSize is the number of samples buffered in memory while the database is unavailable (1000 by default)
+	BufferOverflow    string //BufferOverflow is the sample dropped when the buffer is full, oldest (default) or newest
+	KeepMonths        int    //KeepMonths is the number of months of database files kept, including current month. Forever when 0
+	KeepUnsentMonths  int    //KeepUnsentMonths keep database files with unsent data longer than KeepMonths when it is more
+	MinFreeMB         int    //MinFreeMB is the free space of MainFolder in MB below which the oldest files are removed, disabled when 0
+	RecoveryDevice    string //RecoveryDevice is the block device of MainFolder, which replaces [Device] in RecoveryCommands
+	//RecoveryCommands are run in order when MainFolder becomes read-only or fails with I/O errors. [Device] and
+	//[MainFolder] are replaced, and the command is split by spaces. Set to [] to run no command
+	RecoveryCommands []string
+	RecoveryInterval int    //RecoveryInterval is the interval of retrying recovery in second
+	FallbackFolder   string //FallbackFolder keeps samples while MainFolder is not writable, e.g. in tmpfs. Disabled when empty
 }
 
 type LogConfig struct {
@@ -72,13 +124,184 @@ type MqttConfig struct {
 	Qos                  byte   //Qos for communication
 	WillTopic            string
 	WillPayload          string
+	OnlinePayload        string  //Retained payload published to WillTopic on connect, which the will overwrites
+	RawTopic             string  //Topic for sending raw data
+	PollutantTopic       string  //Topic for sending pollutant data
+	ResendRawTopic       string  //Topic for resending raw data
+	ResendPollutantTopic string  //Topic for resending pollutant data
+	ResendingInterval    int     //Maximum retry interval of the outbox in minute
+	ResendBatchSize      int     //Number of rows committed in one batch when resending (100 by default)
+	ResendRate           float64 //Maximum messages per second resent to each remote, live messages take priority. No limit when 0
+	ResendByteRate       float64 //Maximum bytes per second resent to each remote, live messages take priority. No limit when 0
+	MetricsTopic         string  //Topic for publishing metrics in JSON
+	MetricsInterval      int     //Interval of publishing metrics in second, disabled when 0
+	HeartbeatTopic       string  //Topic for publishing heartbeat in JSON
+	HeartbeatInterval    int     //Interval of publishing heartbeat in second, disabled when 0
+	CommandTopic         string  //Topic for remote commands, responses are published to <CommandTopic>/response/<RequestID>
+	CommandToken         string  //Token required by every remote command, commands are rejected when empty
+	KeyFile              string  //Client key for TLS authentication
+	CertFile             string  //Client certificate for TLS authentication
+	CAFile               string  //CA bundle to verify the broker certificate, system CAs are used when empty
+	Username             string
+	Password             string
+	ServerName           string //Override the server name used to verify the broker certificate
+	InsecureSkipVerify   bool   //Skip verifying the broker certificate, only for lab use
+}
+
+//RemoteConfig is the config for one named remote destination. Topics not configured are the same as [mqtt].
+//For HTTP destination, the topic is appended to URL as the path to post to
+type RemoteConfig struct {
+	Name                 string  //Name of the destination, which is used to track delivery state
+	Type                 string  //Type of the destination, mqtt (default) or http
+	Servers              string  //MQTT server address with port number
+	URL                  string  //HTTP(S) endpoint for http destination
+	Format               string  //Payload format for http destination, msgpack (default) or json
+	BatchSize            int     //Number of rows posted in one request when resending by http destination, 1 when not set
+	ResendRate           float64 //Maximum messages per second when resending, the same as [mqtt] when not set
+	ResendByteRate       float64 //Maximum bytes per second when resending, the same as [mqtt] when not set
+	Token                string  //Bearer token for http destination
+	Qos                  byte    //Qos for communication
+	WillTopic            string
+	WillPayload          string
+	OnlinePayload        string
 	RawTopic             string //Topic for sending raw data
 	PollutantTopic       string //Topic for sending pollutant data
 	ResendRawTopic       string //Topic for resending raw data
 	ResendPollutantTopic string //Topic for resending pollutant data
-	ResendingInterval    int    //Sending Interval in second
-	KeyFile              string
-	CertFile             string
+	KeyFile              string //Client key for TLS authentication
+	CertFile             string //Client certificate for TLS authentication
+	CAFile               string //CA bundle to verify the broker certificate, system CAs are used when empty
+	Username             string
+	Password             string
+	ServerName           string //Override the server name used to verify the broker certificate
+	InsecureSkipVerify   bool   //Skip verifying the broker certificate, only for lab use
+}
+
+//Remotes return the remote destinations. When no [[remote]] is configured, the only destination
+//is built from [mqtt] and named DefaultRemoteName. A remote without name is named by its position
+func (config Config) Remotes() []RemoteConfig {
+	if len(config.Remote) == 0 {
+		return []RemoteConfig{{
+			Name:                 DefaultRemoteName,
+			Type:                 RemoteTypeMqtt,
+			Servers:              config.Mqtt.Servers,
+			Qos:                  config.Mqtt.Qos,
+			WillTopic:            config.Mqtt.WillTopic,
+			WillPayload:          config.Mqtt.WillPayload,
+			OnlinePayload:        config.Mqtt.OnlinePayload,
+			RawTopic:             config.Mqtt.RawTopic,
+			PollutantTopic:       config.Mqtt.PollutantTopic,
+			ResendRawTopic:       config.Mqtt.ResendRawTopic,
+			ResendPollutantTopic: config.Mqtt.ResendPollutantTopic,
+			ResendRate:           config.Mqtt.ResendRate,
+			ResendByteRate:       config.Mqtt.ResendByteRate,
+			KeyFile:              config.Mqtt.KeyFile,
+			CertFile:             config.Mqtt.CertFile,
+			CAFile:               config.Mqtt.CAFile,
+			Username:             config.Mqtt.Username,
+			Password:             config.Mqtt.Password,
+			ServerName:           config.Mqtt.ServerName,
+			InsecureSkipVerify:   config.Mqtt.InsecureSkipVerify,
+		}}
+	}
+	remotes := make([]RemoteConfig, len(config.Remote))
+	for i, remote := range config.Remote {
+		defaultString(&remote.Name, fmt.Sprintf("remote%v", i+1))
+		defaultString(&remote.Type, RemoteTypeMqtt)
+		defaultString(&remote.Format, FormatMsgpack)
+		defaultString(&remote.WillTopic, config.Mqtt.WillTopic)
+		defaultString(&remote.WillPayload, config.Mqtt.WillPayload)
+		defaultString(&remote.OnlinePayload, config.Mqtt.OnlinePayload)
+		defaultString(&remote.RawTopic, config.Mqtt.RawTopic)
+		defaultString(&remote.PollutantTopic, config.Mqtt.PollutantTopic)
+		defaultString(&remote.ResendRawTopic, config.Mqtt.ResendRawTopic)
+		defaultString(&remote.ResendPollutantTopic, config.Mqtt.ResendPollutantTopic)
+		if remote.ResendRate == 0 {
+			remote.ResendRate = config.Mqtt.ResendRate
+		}
+		if remote.ResendByteRate == 0 {
+			remote.ResendByteRate = config.Mqtt.ResendByteRate
+		}
+		remotes[i] = remote
+	}
+	return remotes
+}
+
+//checkRemotes check that every remote destination has its own name, since delivery state and resends are tracked by name
+func checkRemotes(remotes []RemoteConfig) error {
+	names := make(map[string]bool)
+	for _, remote := range remotes {
+		if strings.TrimSpace(remote.Name) == "" {
+			return fmt.Errorf("Remote name should not be empty")
+		}
+		if names[remote.Name] {
+			return fmt.Errorf("Duplicate remote name %v", remote.Name)
+		}
+		names[remote.Name] = true
+	}
+	return nil
+}
+
+//RemoteNames return the names of the remote destinations
+func (config Config) RemoteNames() []string {
+	var names []string
+	for _, remote := range config.Remotes() {
+		names = append(names, remote.Name)
+	}
+	return names
+}
+
+//LocalMqttConfig is the config for the local MQTT broker which the sensor service publishes data to
+type LocalMqttConfig struct {
+	Servers        string //MQTT server addresses with port number, separated by comma
+	Username       string
+	Password       string
+	CAFile         string //CA bundle to verify the broker certificate
+	CertFile       string //Client certificate for TLS authentication
+	KeyFile        string //Client key for TLS authentication
+	ClientIDSuffix string //Suffix appended to ClientID for local MQTT client
+}
+
+//ServerList return the configured server addresses
+func (config LocalMqttConfig) ServerList() []string {
+	var servers []string
+	for _, server := range strings.Split(config.Servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+//setDefaults fill in the default values of the fields not configured
+func (config *Config) setDefaults() {
+	if config.LocalMqtt.Servers == "" {
+		config.LocalMqtt.Servers = DefaultLocalMqttServers
+	}
+	if config.LocalMqtt.ClientIDSuffix == "" {
+		config.LocalMqtt.ClientIDSuffix = DefaultLocalMqttClientIDSuffix
+	}
+	if config.Mqtt.OnlinePayload == "" {
+		config.Mqtt.OnlinePayload = DefaultOnlinePayload
+	}
+	if config.Server.HTTPListen == "" {
+		config.Server.HTTPListen = DefaultHTTPListen
+	}
+	if config.Server.BufferSize <= 0 {
+		config.Server.BufferSize = DefaultBufferSize
+	}
+	if config.Server.BufferOverflow != BufferDropNewest {
+		config.Server.BufferOverflow = BufferDropOldest
+	}
+	if config.Server.RecoveryDevice == "" {
+		config.Server.RecoveryDevice = DefaultRecoveryDevice
+	}
+	if config.Server.RecoveryCommands == nil {
+		config.Server.RecoveryCommands = DefaultRecoveryCommands
+	}
+	if config.Server.RecoveryInterval <= 0 {
+		config.Server.RecoveryInterval = DefaultRecoveryInterval
+	}
 }
 
 func ReadConf(configPath string) (Config, error) {
@@ -106,6 +329,10 @@ func ReadConf(configPath string) (Config, error) {
 			return conf.DataSync, err
 		}
 	}
+	conf.DataSync.setDefaults()
+	if err = checkRemotes(conf.DataSync.Remotes()); err != nil {
+		return conf.DataSync, err
+	}
 	return conf.DataSync, nil
 }
 
@@ -120,6 +347,9 @@ func ReadUserConf(configPath string) (UserConfig, error) {
 	if err != nil {
 		return conf, err
 	}
+	if err = checkRemotes(Config{Remote: conf.Remote}.Remotes()); err != nil {
+		return conf, err
+	}
 	return conf, nil
 }
 
@@ -129,6 +359,19 @@ func (config *Config) MergeUserConfig(userconfig UserConfig) {
 	config.Server.LogRaw = userconfig.Server.LogRaw
 	config.Server.SendPollutantData = userconfig.Server.SendPollutantData
 	config.Server.SendRawData = userconfig.Server.SendRawData
+	if userconfig.Server.BufferSize > 0 {
+		config.Server.BufferSize = userconfig.Server.BufferSize
+	}
+	mergeString(&config.Server.BufferOverflow, userconfig.Server.BufferOverflow)
+	if userconfig.Server.KeepMonths > 0 {
+		config.Server.KeepMonths = userconfig.Server.KeepMonths
+	}
+	if userconfig.Server.KeepUnsentMonths > 0 {
+		config.Server.KeepUnsentMonths = userconfig.Server.KeepUnsentMonths
+	}
+	if userconfig.Server.MinFreeMB > 0 {
+		config.Server.MinFreeMB = userconfig.Server.MinFreeMB
+	}
 
 	//Merge user config (Mqtt part)
 	config.Mqtt.ClientID = userconfig.Mqtt.ClientID
@@ -140,4 +383,137 @@ func (config *Config) MergeUserConfig(userconfig UserConfig) {
 	config.Mqtt.WillTopic = userconfig.Mqtt.WillTopic
 	config.Mqtt.WillPayload = userconfig.Mqtt.WillPayload
 	config.Mqtt.ResendingInterval = userconfig.Mqtt.ResendingInterval
+	if userconfig.Mqtt.ResendBatchSize > 0 {
+		config.Mqtt.ResendBatchSize = userconfig.Mqtt.ResendBatchSize
+	}
+	if userconfig.Mqtt.ResendRate > 0 {
+		config.Mqtt.ResendRate = userconfig.Mqtt.ResendRate
+	}
+	if userconfig.Mqtt.ResendByteRate > 0 {
+		config.Mqtt.ResendByteRate = userconfig.Mqtt.ResendByteRate
+	}
+
+	//Merge user config (Local Mqtt part), only the fields set by user overwrite the default
+	mergeString(&config.LocalMqtt.Servers, userconfig.LocalMqtt.Servers)
+	mergeString(&config.LocalMqtt.Username, userconfig.LocalMqtt.Username)
+	mergeString(&config.LocalMqtt.Password, userconfig.LocalMqtt.Password)
+	mergeString(&config.LocalMqtt.CAFile, userconfig.LocalMqtt.CAFile)
+	mergeString(&config.LocalMqtt.CertFile, userconfig.LocalMqtt.CertFile)
+	mergeString(&config.LocalMqtt.KeyFile, userconfig.LocalMqtt.KeyFile)
+	mergeString(&config.LocalMqtt.ClientIDSuffix, userconfig.LocalMqtt.ClientIDSuffix)
+	config.setDefaults()
+
+	//Merge user config (Remote part), the whole list is replaced when user configures any remote
+	if len(userconfig.Remote) > 0 {
+		config.Remote = userconfig.Remote
+	}
+}
+
+//Redacted return a copy of the config with every password and token replaced by RedactedSecret
+func (config Config) Redacted() Config {
+	redactString(&config.Server.HTTPToken)
+	redactString(&config.Mqtt.Password)
+	redactString(&config.Mqtt.CommandToken)
+	redactString(&config.LocalMqtt.Password)
+	remotes := make([]RemoteConfig, len(config.Remote))
+	for i, remote := range config.Remote {
+		redactString(&remote.Password)
+		redactString(&remote.Token)
+		remotes[i] = remote
+	}
+	config.Remote = remotes
+	return config
+}
+
+//Set set the field of [server] or [mqtt] section, e.g. "Server.LogRaw", to the value decoded from JSON.
+//Section and field names are case insensitive. Numbers should be integers within the range of the field
+func (userconfig *UserConfig) Set(name string, value interface{}) error {
+	parts := strings.Split(name, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid field %v, should be <Section>.<Field>", name)
+	}
+	var section reflect.Value
+	switch strings.ToLower(parts[0]) {
+	case "server":
+		section = reflect.ValueOf(&userconfig.Server).Elem()
+	case "mqtt":
+		section = reflect.ValueOf(&userconfig.Mqtt).Elem()
+	default:
+		return fmt.Errorf("Unknown section %v", parts[0])
+	}
+	field := section.FieldByNameFunc(func(field string) bool {
+		return strings.EqualFold(field, parts[1])
+	})
+	if !field.IsValid() {
+		return fmt.Errorf("Unknown field %v", name)
+	}
+	switch field.Kind() {
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("Field %v should be a boolean", name)
+		}
+		field.SetBool(b)
+	case reflect.String:
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("Field %v should be a string", name)
+		}
+		field.SetString(str)
+	case reflect.Float64:
+		number, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("Field %v should be a number", name)
+		}
+		field.SetFloat(number)
+	case reflect.Int, reflect.Uint8:
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fmt.Errorf("Field %v should be an integer", name)
+		}
+		if field.Kind() == reflect.Int {
+			if field.OverflowInt(int64(number)) {
+				return fmt.Errorf("Field %v is out of range", name)
+			}
+			field.SetInt(int64(number))
+		} else {
+			if number < 0 || field.OverflowUint(uint64(number)) {
+				return fmt.Errorf("Field %v is out of range", name)
+			}
+			field.SetUint(uint64(number))
+		}
+	default:
+		return fmt.Errorf("Field %v is not supported", name)
+	}
+	return nil
+}
+
+//WriteUserConf write the user config file in TOML
+func WriteUserConf(configPath string, conf UserConfig) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(conf); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath, buf.Bytes(), 0644)
+}
+
+//redactString replace the target with RedactedSecret when it is not empty
+func redactString(target *string) {
+	if *target != "" {
+		*target = RedactedSecret
+	}
+}
+
+//mergeString overwrite the target with value when value is not empty
+func mergeString(target *string, value string) {
+	if value != "" {
+		*target = value
+	}
+}
+
+//defaultString set the target to value when target is empty
+func defaultString(target *string, value string) {
+	if *target == "" {
+		*target = value
+	}
 }
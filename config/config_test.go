@@ -0,0 +1,130 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestMergeLocalMqtt(t *testing.T) {
+	var conf Config
+	conf.setDefaults()
+	var user UserConfig
+	_, err := toml.Decode(`
+[localmqtt]
+	Servers = "tcp://192.168.1.10:1883, ssl://192.168.1.10:8883"
+	Username = "datasync"
+`, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.MergeUserConfig(user)
+	if servers := conf.LocalMqtt.ServerList(); len(servers) != 2 || servers[1] != "ssl://192.168.1.10:8883" {
+		t.Fatalf("Unexpected local MQTT servers:%v", servers)
+	}
+	if conf.LocalMqtt.Username != "datasync" || conf.LocalMqtt.ClientIDSuffix != DefaultLocalMqttClientIDSuffix {
+		t.Fatalf("Unexpected local MQTT config:%+v", conf.LocalMqtt)
+	}
+	conf.MergeUserConfig(UserConfig{})
+	if conf.LocalMqtt.Servers == "" || conf.LocalMqtt.Username != "datasync" {
+		t.Fatalf("Empty user config should not overwrite local MQTT config:%+v", conf.LocalMqtt)
+	}
+}
+
+func TestRemotes(t *testing.T) {
+	var conf Config
+	conf.Mqtt.Servers = "ssl://cloud:8883"
+	conf.Mqtt.PollutantTopic = "airsence/AUG/+/pollutant"
+	conf.Mqtt.CAFile = "ca.pem"
+	if remotes := conf.Remotes(); len(remotes) != 1 ||
+		remotes[0].Name != DefaultRemoteName ||
+		remotes[0].Servers != "ssl://cloud:8883" ||
+		remotes[0].CAFile != "ca.pem" {
+		t.Fatalf("Unexpected default remote:%+v", remotes)
+	}
+	var user UserConfig
+	_, err := toml.Decode(`
+[mqtt]
+	PollutantTopic = "airsence/AUG/+/pollutant"
+[[remote]]
+	Name = "cloud"
+	Servers = "ssl://cloud:8883"
+[[remote]]
+	Servers = "tcp://customer:1883"
+	PollutantTopic = "customer/+/pollutant"
+`, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.MergeUserConfig(user)
+	remotes := conf.Remotes()
+	if len(remotes) != 2 || remotes[0].PollutantTopic != "airsence/AUG/+/pollutant" || remotes[0].CAFile != "" {
+		t.Fatalf("Unexpected remotes:%+v", remotes)
+	}
+	if remotes[1].Name != "remote2" || remotes[1].PollutantTopic != "customer/+/pollutant" {
+		t.Fatalf("Unexpected second remote:%+v", remotes[1])
+	}
+}
+
+func TestDuplicateRemoteNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config_user.toml")
+	for content, valid := range map[string]bool{
+		"[[remote]]\n\tName = \"cloud\"\n[[remote]]\n\tName = \"customer\"\n": true,
+		"[[remote]]\n\tName = \"cloud\"\n[[remote]]\n\tName = \"cloud\"\n":    false,
+		"[[remote]]\n[[remote]]\n\tName = \"remote1\"\n":                      false,
+		"[[remote]]\n\tName = \" \"\n":                                        false,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadUserConf(path); (err == nil) != valid {
+			t.Fatalf("Unexpected result of reading remotes %q:%v", content, err)
+		}
+	}
+}
+
+func TestUserConfigSet(t *testing.T) {
+	var user UserConfig
+	for name, value := range map[string]interface{}{
+		"Server.SendRawData": true,
+		"mqtt.Qos":           float64(1),
+		"Mqtt.RawTopic":      "airsence/AUG/+/raw",
+	} {
+		if err := user.Set(name, value); err != nil {
+			t.Fatalf("Unable to set %v:%v", name, err)
+		}
+	}
+	if !user.Server.SendRawData || user.Mqtt.Qos != 1 || user.Mqtt.RawTopic != "airsence/AUG/+/raw" {
+		t.Fatalf("Unexpected user config:%+v", user)
+	}
+	for name, value := range map[string]interface{}{
+		"Qos":                    float64(1),
+		"Log.Filename":           "datasync.log",
+		"Mqtt.Unknown":           true,
+		"Mqtt.Qos":               float64(256),
+		"Mqtt.ResendingInterval": 1.5,
+		"Server.LogRaw":          "true",
+	} {
+		if err := user.Set(name, value); err == nil {
+			t.Fatalf("Expect error when set %v to %v", name, value)
+		}
+	}
+}
+
+func TestRecoveryDefaults(t *testing.T) {
+	var conf Config
+	conf.setDefaults()
+	if conf.Server.RecoveryDevice != DefaultRecoveryDevice || len(conf.Server.RecoveryCommands) != 1 {
+		t.Fatalf("Expect SD card repaired by default, got %+v", conf.Server)
+	}
+	conf = Config{}
+	if _, err := toml.Decode("[server]\n\tRecoveryCommands = []\n", &conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.setDefaults()
+	if conf.Server.RecoveryCommands == nil || len(conf.Server.RecoveryCommands) != 0 {
+		t.Fatalf("Expect no recovery command when configured empty, got %v", conf.Server.RecoveryCommands)
+	}
+}
@@ -3,13 +3,13 @@ module aws.airsence/datasync
 go 1.16
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.3.2 // indirect
-	github.com/mattn/go-sqlite3 v1.14.6 // indirect
-	github.com/sirupsen/logrus v1.8.1 // indirect
-	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
-	github.com/yeka/zip v0.0.0-20180914125537-d046722c6feb // indirect
+	github.com/BurntSushi/toml v0.3.1
+	github.com/eclipse/paho.mqtt.golang v1.3.2
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/sirupsen/logrus v1.8.1
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	github.com/yeka/zip v0.0.0-20180914125537-d046722c6feb
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
-	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 )
@@ -0,0 +1,344 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSampleLimit = 100  //defaultSampleLimit is the number of samples returned by /samples when limit is not given
+	maxSampleLimit     = 1000 //maxSampleLimit is the maximum number of samples returned by /samples
+)
+
+//Status is the connection status of the service
+type Status struct {
+	ClientID       string
+	LocalConnected bool
+	DatabaseOpen   bool
+	Fallback       bool //Fallback is true while samples are saved in FallbackFolder because MainFolder is not writable
+	Remotes        []RemoteStatus
+	Purges         []PurgeReport //Purges are the latest partitions removed by the retention policy
+}
+
+//RemoteStatus is the connection status of a remote destination
+type RemoteStatus struct {
+	Name      string
+	Connected bool
+}
+
+//Sample is a stored sample returned by the local HTTP API, the data is converted to JSON
+type Sample struct {
+	ID        int64
+	File      string
+	Timestamp int64
+	Data      json.RawMessage
+}
+
+//APIResendRequest is the resend request of the local HTTP API. Table is raw or pollutant
+type APIResendRequest struct {
+	Table string
+	ResendRequest
+}
+
+//APIResendResponse is the response of a resend request of the local HTTP API. Result is empty, since the
+//response is written once the resend is started in background
+type APIResendResponse struct {
+	Success bool
+	Message string
+	Result  ResendResult
+}
+
+//apiError is the response of the local HTTP API when the request fails
+type apiError struct {
+	Error string
+}
+
+//serveAPI start the local HTTP API in background and return the server, so it can be shut down
+func (handler *Handler) serveAPI() *http.Server {
+	server := &http.Server{
+		Addr:    handler.conf().Server.HTTPListen,
+		Handler: handler.apiHandler(),
+	}
+	go func() {
+		handler.MainLogger.Infof("Local HTTP API listens on %v", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			handler.MainLogger.Errorf("Error when serve local HTTP API:%v", err)
+		}
+	}()
+	return server
+}
+
+//shutdownAPI stop the local HTTP API and wait at most 5 seconds for requests in progress
+func (handler *Handler) shutdownAPI(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		handler.MainLogger.Errorf("Error when shut down local HTTP API:%v", err)
+	}
+}
+
+//apiHandler return the HTTP handler of the local HTTP API:
+//
+//	GET  /status       connection status of local and remote brokers and database
+//	GET  /backlog      number of unsent rows of each table for each remote, between start and end
+//	GET  /samples      stored samples of the table between start and end, at most limit of them, with any of the keys when given
+//	GET  /deadletters  invalid messages quarantined between start and end, at most limit of them
+//	POST /resend       resend a table between StartDate and EndDate (APIResendRequest in JSON)
+//	GET  /metrics      metrics in Prometheus text format
+//
+//start and end are Unix time, every request needs the bearer token when HTTPToken is configured
+func (handler *Handler) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handler.statusAPI)
+	mux.HandleFunc("/backlog", handler.backlogAPI)
+	mux.HandleFunc("/samples", handler.samplesAPI)
+	mux.HandleFunc("/deadletters", handler.deadLettersAPI)
+	mux.HandleFunc("/resend", handler.resendAPI)
+	mux.HandleFunc("/metrics", handler.metricsAPI)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := handler.conf().Server.HTTPToken
+		authorization := []byte(r.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(authorization, []byte("Bearer "+token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "Unauthorized"})
+			return
+		}
+		handler.MainLogger.Infof("Local HTTP API %v %v from %v", r.Method, r.URL.Path, r.RemoteAddr)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+//statusAPI respond the connection status
+func (handler *Handler) statusAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, handler.status())
+}
+
+//status return the connection status of local and remote brokers and database
+func (handler *Handler) status() Status {
+	status := Status{
+		ClientID:       handler.conf().Mqtt.ClientID,
+		LocalConnected: handler.isLocalConnected(),
+		DatabaseOpen:   handler.Store() != nil,
+		Fallback:       handler.usingFallback(),
+		Purges:         handler.purges.latest(),
+	}
+	for _, remote := range handler.Remotes {
+		status.Remotes = append(status.Remotes, RemoteStatus{Name: remote.Name, Connected: remote.isConnected()})
+	}
+	return status
+}
+
+//backlogAPI respond the number of unsent rows of each table for each remote
+func (handler *Handler) backlogAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	startdate, enddate, err := timeRange(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	store := handler.Store()
+	if store == nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: "Database not connected"})
+		return
+	}
+	backlog := make(map[string]map[string]int)
+	for _, remote := range handler.Remotes {
+		backlog[remote.Name] = make(map[string]int)
+		for _, table := range []string{RawTable, PollutantTable} {
+			count, err := store.CountUnsent(remote.Name, table, startdate, enddate)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, apiError{Error: fmt.Sprintf("Error when count %v:%v", table, err)})
+				return
+			}
+			backlog[remote.Name][table] = count
+		}
+	}
+	writeJSON(w, http.StatusOK, backlog)
+}
+
+//samplesAPI respond the stored samples of the table between start and end
+func (handler *Handler) samplesAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	table := r.URL.Query().Get("table")
+	if table != RawTable && table != PollutantTable {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("Unknown table %v", table)})
+		return
+	}
+	startdate, enddate, err := timeRange(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultSampleLimit)
+	if err != nil || limit <= 0 || limit > maxSampleLimit {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("limit should be between 1 and %v", maxSampleLimit)})
+		return
+	}
+	store := handler.Store()
+	if store == nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: "Database not connected"})
+		return
+	}
+	records, err := store.Find(Filter{
+		Table:     table,
+		StartDate: startdate,
+		EndDate:   enddate,
+		Limit:     int(limit),
+		Keys:      r.URL.Query()["key"],
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: fmt.Sprintf("Error when query %v:%v", table, err)})
+		return
+	}
+	samples := make([]Sample, 0, len(records))
+	for _, record := range records {
+		data, err := msgpackToJSON(record.Data)
+		if err != nil {
+			handler.MainLogger.Errorf("Unable to convert %v sample %v of %v:%v", table, record.ID, record.Partition, err)
+			continue
+		}
+		samples = append(samples, Sample{
+			ID:        record.ID,
+			File:      record.Partition,
+			Timestamp: record.Timestamp,
+			Data:      data,
+		})
+	}
+	writeJSON(w, http.StatusOK, samples)
+}
+
+//deadLettersAPI respond the invalid messages quarantined between start and end, oldest first
+func (handler *Handler) deadLettersAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	startdate, enddate, err := timeRange(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultSampleLimit)
+	if err != nil || limit <= 0 || limit > maxSampleLimit {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("limit should be between 1 and %v", maxSampleLimit)})
+		return
+	}
+	store := handler.Store()
+	if store == nil {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: "Database not connected"})
+		return
+	}
+	letters, err := store.DeadLetters(startdate, enddate, int(limit))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: fmt.Sprintf("Error when query dead letters:%v", err)})
+		return
+	}
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+//resendAPI resend the table to the destination, or every remote when Destination is empty. The resend runs in
+//background like a resend request, so it is accepted at once and the result is only logged
+func (handler *Handler) resendAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	var request APIResendRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("Unable to parse resend request:%v", err)})
+		return
+	}
+	if request.Table != RawTable && request.Table != PollutantTable {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("Unknown table %v", request.Table)})
+		return
+	}
+	if err := request.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("Invalid resend request:%v", err)})
+		return
+	}
+	remotes, err := handler.resendTargets(nil, request.Destination)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	handler.MainLogger.Infof("Resending %v data triggered by local HTTP API.", request.Table)
+	started := handler.background(func() {
+		result, err := handler.resendRemotes(remotes, request.Table, request.ResendRequest)
+		if err != nil {
+			handler.MainLogger.Errorf("Fail to resend:%v (%+v)", err, result)
+			return
+		}
+		handler.MainLogger.Infof("Successfully resend %v data by local HTTP API:%+v", request.Table, result)
+	})
+	if !started {
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: "Service is shutting down"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, APIResendResponse{
+		Success: true,
+		Message: fmt.Sprintf("Resending %v data in background", request.Table),
+	})
+}
+
+//metricsAPI respond the metrics in Prometheus text format
+func (handler *Handler) metricsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "Method not allowed"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	handler.metricsSnapshot().WritePrometheus(w)
+}
+
+//timeRange parse start and end of the request, which are 0 and now by default
+func timeRange(r *http.Request) (int64, int64, error) {
+	startdate, err := queryInt(r, "start", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	enddate, err := queryInt(r, "end", time.Now().Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+	if startdate > enddate {
+		return 0, 0, fmt.Errorf("start should not be after end")
+	}
+	return startdate, enddate, nil
+}
+
+//queryInt parse the integer query parameter of the request, value is returned when it is not given
+func queryInt(r *http.Request, key string, value int64) (int64, error) {
+	str := r.URL.Query().Get(key)
+	if str == "" {
+		return value, nil
+	}
+	number, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v:%v", key, str)
+	}
+	return number, nil
+}
+
+//writeJSON write the value as JSON response with the status code
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+//apiRequest send the request to the local HTTP API of the handler and decode the JSON response
+func apiRequest(t *testing.T, handler *Handler, method string, target string, body string, response interface{}) int {
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+handler.config.Server.HTTPToken)
+	recorder := httptest.NewRecorder()
+	handler.apiHandler().ServeHTTP(recorder, request)
+	if response != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatalf("Unable to decode response %v:%v", recorder.Body.String(), err)
+		}
+	}
+	return recorder.Code
+}
+
+func TestAPIStatusAndBacklog(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	handler.config.Server.HTTPToken = "secret"
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+1))
+
+	var status Status
+	if code := apiRequest(t, handler, http.MethodGet, "/status", "", &status); code != http.StatusOK {
+		t.Fatalf("Unexpected status code %v", code)
+	}
+	if !status.LocalConnected || !status.DatabaseOpen || len(status.Remotes) != 1 || !status.Remotes[0].Connected {
+		t.Fatalf("Unexpected status:%+v", status)
+	}
+	var backlog map[string]map[string]int
+	if code := apiRequest(t, handler, http.MethodGet, "/backlog", "", &backlog); code != http.StatusOK {
+		t.Fatalf("Unexpected backlog code %v", code)
+	}
+	if backlog[config.DefaultRemoteName][PollutantTable] != 2 || backlog[config.DefaultRemoteName][RawTable] != 0 {
+		t.Fatalf("Unexpected backlog:%v", backlog)
+	}
+	if code := apiRequest(t, handler, http.MethodGet, fmt.Sprintf("/backlog?start=%v", ts+1), "", &backlog); code != http.StatusOK ||
+		backlog[config.DefaultRemoteName][PollutantTable] != 1 {
+		t.Fatalf("Unexpected backlog since %v:%v (%v)", ts+1, backlog, code)
+	}
+	if code := apiRequest(t, handler, http.MethodGet, "/backlog?start=abc", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expect bad request for invalid start, got %v", code)
+	}
+
+	handler.config.Server.HTTPToken = "other"
+	request := httptest.NewRequest(http.MethodGet, "/status", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	handler.apiHandler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("Expect unauthorized with wrong token, got %v", recorder.Code)
+	}
+}
+
+func TestAPISamplesAndResend(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+1))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+2))
+
+	var samples []Sample
+	target := fmt.Sprintf("/samples?table=pollutant&start=%v&end=%v&limit=2", ts, ts+10)
+	if code := apiRequest(t, handler, http.MethodGet, target, "", &samples); code != http.StatusOK {
+		t.Fatalf("Unexpected samples code %v", code)
+	}
+	if len(samples) != 2 || samples[0].Timestamp != ts || samples[1].Timestamp != ts+1 {
+		t.Fatalf("Unexpected samples:%+v", samples)
+	}
+	var data PollutantDataMsgPack
+	if err := json.Unmarshal(samples[0].Data, &data); err != nil || data.PollutantData["NO"] != 1.5 {
+		t.Fatalf("Unexpected sample data %s (%v)", samples[0].Data, err)
+	}
+	for key, expected := range map[string]int{"NO2": 3, "CO": 0} {
+		target = fmt.Sprintf("/samples?table=pollutant&start=%v&end=%v&key=%v", ts, ts+10, key)
+		if code := apiRequest(t, handler, http.MethodGet, target, "", &samples); code != http.StatusOK || len(samples) != expected {
+			t.Fatalf("Expect %v samples with %v, got %v (%v)", expected, key, len(samples), code)
+		}
+	}
+	if code := apiRequest(t, handler, http.MethodGet, "/samples?table=other", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expect bad request for unknown table, got %v", code)
+	}
+
+	remote.SetPublishErr(nil)
+	var response APIResendResponse
+	body := fmt.Sprintf(`{"Table":"pollutant","StartDate":%v,"EndDate":%v}`, ts, ts+10)
+	if code := apiRequest(t, handler, http.MethodGet, "/resend", body, nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expect resend only by POST, got %v", code)
+	}
+	if code := apiRequest(t, handler, http.MethodPost, "/resend", body, &response); code != http.StatusAccepted || !response.Success {
+		t.Fatalf("Unexpected resend code %v:%+v", code, response)
+	}
+	handler.jobs.Wait()
+	if published := remote.Published(handler.PollutantTopic); len(published) != 3 {
+		t.Fatalf("Expect 2 samples resent after the live one, got %v published", len(published))
+	}
+	if count, _ := store.CountUnsent(config.DefaultRemoteName, PollutantTable, ts, ts+10); count != 0 {
+		t.Fatalf("Expect every sample marked sent, got %v unsent", count)
+	}
+
+	handler.waitJobs()
+	if code := apiRequest(t, handler, http.MethodPost, "/resend", body, nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expect resend refused while shutting down, got %v", code)
+	}
+}
@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+const (
+	CommandStatus  = "status"  //CommandStatus respond the connection status and the heartbeat
+	CommandConfig  = "config"  //CommandConfig respond the config with passwords and tokens redacted
+	CommandSet     = "set"     //CommandSet set fields of the user config file and merge them into the config
+	CommandFlush   = "flush"   //CommandFlush resend the whole backlog to the destination, or every remote
+	CommandPurge   = "purge"   //CommandPurge delete data older than Days days from the database
+	CommandRotate  = "rotate"  //CommandRotate close the database and open the database file of current month again
+	CommandRestart = "restart" //CommandRestart reconnect to local and remote brokers with the topics of current config
+)
+
+//Command is a request received on the command topic of a remote MQTT broker
+type Command struct {
+	RequestID   string                 //RequestID correlates the response, which is published to <CommandTopic>/response/<RequestID>
+	Token       string                 //Token should be the same as CommandToken
+	Command     string                 //Command is one of status, config, set, flush, purge, rotate and restart
+	Fields      map[string]interface{} //Fields of the user config to set, e.g. {"Server.LogRaw":true}
+	Days        int                    //Days of data to keep when purging
+	Destination string                 //Destination to flush, every remote when empty
+}
+
+//CommandResponse is the response of a command
+type CommandResponse struct {
+	RequestID string
+	Command   string
+	Success   bool
+	Message   string
+	Data      interface{}
+}
+
+//StatusReport is the data responded to status command
+type StatusReport struct {
+	Status    Status
+	Heartbeat Heartbeat
+}
+
+/*commandHandler is the handler for commands from a remote MQTT broker. The response is published on the
+same broker to <CommandTopic>/response/<RequestID>. The request format should be (in json)
+
+{
+	"RequestID":(Unique ID of the request in string),
+	"Token":(CommandToken in string),
+	"Command":(status, config, set, flush, purge, rotate or restart),
+	"Fields":(Optional user config fields to set, e.g. {"Server.LogRaw":true}),
+	"Days":(Optional days of data to keep when purging),
+	"Destination":(Optional remote name to flush)
+}
+*/
+func (handler *Handler) commandHandler(transport Transport, msg Message) {
+	var command Command
+	if err := json.Unmarshal(msg.Payload(), &command); err != nil {
+		response := CommandResponse{Message: fmt.Sprintf("Unable to parse command:%v", err)}
+		handler.MainLogger.Errorf(response.Message)
+		handler.publishCommandResponse(transport, msg.Topic(), command, response)
+		return
+	}
+	//Flush may wait long for the rate limits, so it runs in background like resend requests
+	if command.Command == CommandFlush {
+		handler.background(func() {
+			handler.respondCommand(transport, msg.Topic(), command)
+		})
+		return
+	}
+	handler.respondCommand(transport, msg.Topic(), command)
+}
+
+//respondCommand run the command arrived on the topic and publish the response. Restart is done after the response is published
+func (handler *Handler) respondCommand(transport Transport, topic string, command Command) {
+	response := handler.runCommand(transport, command)
+	handler.publishCommandResponse(transport, topic, command, response)
+	if response.Success && response.Command == CommandRestart {
+		go handler.restart()
+	}
+}
+
+//publishCommandResponse publish the response of the command arrived on the topic to <topic>/response/<RequestID>
+func (handler *Handler) publishCommandResponse(transport Transport, topic string, command Command, response CommandResponse) {
+	topic = fmt.Sprintf("%v/response", topic)
+	if command.RequestID != "" {
+		topic = fmt.Sprintf("%v/%v", topic, command.RequestID)
+	}
+	payload, _ := json.Marshal(response)
+	if err := transport.Publish(topic, handler.conf().Mqtt.Qos, false, payload); err != nil {
+		handler.MainLogger.Errorf("Error when publish response to %v:%v", topic, err)
+	}
+}
+
+//runCommand authorize the command arrived on the transport, run it and log the result
+func (handler *Handler) runCommand(transport Transport, command Command) CommandResponse {
+	response := CommandResponse{RequestID: command.RequestID, Command: command.Command}
+	source := "local MQTT broker"
+	if remote := handler.remote(transport); remote != nil {
+		source = remote.Name
+	}
+	handler.MainLogger.Infof("Get command %v (request %v) from %v", command.Command, command.RequestID, source)
+	err := handler.authorize(command)
+	if err == nil {
+		response.Data, err = handler.execute(command)
+	}
+	if err != nil {
+		response.Data = nil
+		response.Message = fmt.Sprintf("Fail to run command %v:%v", command.Command, err)
+		handler.MainLogger.Errorf("%v (request %v)", response.Message, command.RequestID)
+		return response
+	}
+	response.Success = true
+	response.Message = fmt.Sprintf("Successfully run command %v", command.Command)
+	handler.MainLogger.Infof("%v (request %v)", response.Message, command.RequestID)
+	return response
+}
+
+//authorize check the request ID and token of the command. Every command is rejected when CommandToken is not configured
+func (handler *Handler) authorize(command Command) error {
+	if command.RequestID == "" {
+		return fmt.Errorf("RequestID is required")
+	}
+	token := handler.conf().Mqtt.CommandToken
+	if token == "" {
+		return fmt.Errorf("Command token not configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(command.Token), []byte(token)) != 1 {
+		return fmt.Errorf("Unauthorized")
+	}
+	return nil
+}
+
+//execute run the command and return the data of the response. Restart is done after the response is published
+func (handler *Handler) execute(command Command) (interface{}, error) {
+	switch command.Command {
+	case CommandStatus:
+		return StatusReport{Status: handler.status(), Heartbeat: handler.heartbeat()}, nil
+	case CommandConfig:
+		return handler.conf().Redacted(), nil
+	case CommandSet:
+		return handler.setUserConfig(command.Fields)
+	case CommandFlush:
+		return handler.flush(command.Destination)
+	case CommandPurge:
+		return handler.purge(command.Days)
+	case CommandRotate:
+		return nil, handler.rotateDB()
+	case CommandRestart:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unknown command %v", command.Command)
+}
+
+//setUserConfig set the fields in the user config file and merge the user config into the config.
+//The outboxes of the tables enabled for sending are started at once. Topics are applied on restart,
+//client ID and broker changes need the service to be restarted
+func (handler *Handler) setUserConfig(fields map[string]interface{}) (interface{}, error) {
+	if UserConfigPath == "" {
+		return nil, fmt.Errorf("User config file not configured")
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("No field to set")
+	}
+	userconfig, err := config.ReadUserConf(UserConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error when read user config:%v", err)
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = userconfig.Set(name, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err = config.WriteUserConf(UserConfigPath, userconfig); err != nil {
+		return nil, fmt.Errorf("Error when write user config:%v", err)
+	}
+	handler.mergeUserConfig(userconfig)
+	handler.startOutboxes()
+	handler.MainLogger.Infof("User config %v updated", strings.Join(names, ", "))
+	return fields, nil
+}
+
+//flush resend every unsent row of the tables being sent to the destination, or every remote when it is empty.
+//The results are keyed by table
+func (handler *Handler) flush(destination string) (interface{}, error) {
+	remotes, err := handler.resendTargets(nil, destination)
+	if err != nil {
+		return nil, err
+	}
+	conf := handler.conf()
+	results := make(map[string]ResendResult)
+	var errs []string
+	for _, table := range []string{RawTable, PollutantTable} {
+		if (table == RawTable && !conf.Server.SendRawData) ||
+			(table == PollutantTable && !conf.Server.SendPollutantData) {
+			continue
+		}
+		result, err := handler.resendRemotes(remotes, table, ResendRequest{EndDate: time.Now().Unix()})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		results[table] = result
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%v", strings.Join(errs, ", "))
+	}
+	return results, nil
+}
+
+//purge delete every sample older than the days from the store and return the number of samples deleted
+func (handler *Handler) purge(days int) (interface{}, error) {
+	if days <= 0 {
+		return nil, fmt.Errorf("Days should be more than 0")
+	}
+	store := handler.Store()
+	if store == nil {
+		return nil, fmt.Errorf("Database not connected")
+	}
+	before := time.Now().AddDate(0, 0, -days).Unix()
+	count, err := store.Purge(before)
+	if err != nil {
+		handler.checkStorageError(err)
+		return nil, err
+	}
+	handler.MainLogger.Infof("Purged %v samples before %v", count, time.Unix(before, 0).Format(time.RFC3339))
+	return count, nil
+}
+
+//rotateDB close the store and open the database file of current month again, e.g. after the SD card is repaired.
+//When it fails, the database is opened in background like on startup. Samples received meanwhile are buffered.
+//It is refused while the fallback store is in use, since the recovery switches back and merges the fallback samples
+func (handler *Handler) rotateDB() error {
+	if handler.usingFallback() {
+		return fmt.Errorf("Saving samples in fallback folder until main folder is recovered")
+	}
+	if store := handler.SetStore(nil); store != nil {
+		if err := store.Close(); err != nil {
+			handler.MainLogger.Errorf("Unable to close connection with database:%v", err)
+		}
+	}
+	if !handler.db.startOpening() {
+		return fmt.Errorf("Database is being opened")
+	}
+	date := time.Now().UTC()
+	if !clockSynchronized(date) {
+		go handler.initDB()
+		return fmt.Errorf("Clock not synchronized, database will be opened once it is")
+	}
+	store, err := handler.openStore(date)
+	if err != nil {
+		go handler.initDB()
+		return fmt.Errorf("Unable to open database:%v", err)
+	}
+	handler.storeOpened(store)
+	return nil
+}
+
+//restart disconnect from local and remote brokers, apply the topics of current config and connect again
+func (handler *Handler) restart() {
+	handler.MainLogger.Info("Restarting pipeline")
+	handler.LocalMqttClient.Disconnect()
+	handler.setLocalConnected(false)
+	for _, remote := range handler.Remotes {
+		remote.Transport.Disconnect()
+		remote.setConnected(false)
+	}
+	handler.applyTopics()
+	if err := handler.LocalMqttClient.Connect(); err != nil {
+		handler.MainLogger.Errorf("Error when connect to local MQTT broker:%v", err)
+	}
+	for _, remote := range handler.Remotes {
+		if err := remote.Transport.Connect(); err != nil {
+			handler.MainLogger.Errorf("Error when client connect to remote MQTT broker %v:%v", remote.Name, err)
+		}
+	}
+}
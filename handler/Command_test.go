@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+	"github.com/vmihailenco/msgpack"
+)
+
+//commandResult is the response of a command with the data kept in JSON
+type commandResult struct {
+	CommandResponse
+	Data json.RawMessage
+}
+
+//newCommandHandler create the test handler with the command topic subscribed on the remote
+func newCommandHandler(t *testing.T) (*Handler, *fakeTransport, *fakeTransport, *MemoryStore) {
+	handler, local, remote, store := newTestHandler(t)
+	handler.config.Mqtt.CommandTopic = "airsence/AUG/+/cmd"
+	handler.config.Mqtt.CommandToken = "secret"
+	handler.applyTopics()
+	if err := remote.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return handler, local, remote, store
+}
+
+//sendCommand deliver the command on the remote and return the response published to its response topic
+func sendCommand(t *testing.T, handler *Handler, remote *fakeTransport, command Command) commandResult {
+	payload, _ := json.Marshal(command)
+	remote.Deliver(handler.CommandTopic, payload)
+	handler.jobs.Wait()
+	published := remote.Published(fmt.Sprintf("%v/response/%v", handler.CommandTopic, command.RequestID))
+	if len(published) == 0 {
+		t.Fatalf("Expect response of command %v", command.Command)
+	}
+	var result commandResult
+	if err := json.Unmarshal(published[len(published)-1].payload, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestCommandAuthorization(t *testing.T) {
+	handler, _, remote, _ := newCommandHandler(t)
+	if handler.CommandTopic != "airsence/AUG/AirSENCE-Dummy/cmd" {
+		t.Fatalf("Unexpected command topic %v", handler.CommandTopic)
+	}
+	result := sendCommand(t, handler, remote, Command{RequestID: "1", Token: "wrong", Command: CommandStatus})
+	if result.Success || result.RequestID != "1" || !strings.Contains(result.Message, "Unauthorized") {
+		t.Fatalf("Expect command with wrong token rejected, got %+v", result)
+	}
+	remote.Deliver(handler.CommandTopic, []byte(`{"Token":"secret","Command":"status"}`))
+	if published := remote.Published(handler.CommandTopic + "/response"); len(published) != 2 ||
+		!strings.Contains(string(published[1].payload), "RequestID is required") {
+		t.Fatalf("Expect command without request ID rejected, got %v", published)
+	}
+	handler.config.Mqtt.CommandToken = ""
+	result = sendCommand(t, handler, remote, Command{RequestID: "2", Command: CommandStatus})
+	if result.Success {
+		t.Fatalf("Expect every command rejected without command token, got %+v", result)
+	}
+	handler.config.Mqtt.CommandToken = "secret"
+	result = sendCommand(t, handler, remote, Command{RequestID: "3", Token: "secret", Command: "reboot"})
+	if result.Success || !strings.Contains(result.Message, "Unknown command") {
+		t.Fatalf("Expect unknown command rejected, got %+v", result)
+	}
+}
+
+func TestCommandStatusAndConfig(t *testing.T) {
+	handler, _, remote, _ := newCommandHandler(t)
+	handler.config.Mqtt.Password = "password"
+	result := sendCommand(t, handler, remote, Command{RequestID: "1", Token: "secret", Command: CommandStatus})
+	var report StatusReport
+	if err := json.Unmarshal(result.Data, &report); err != nil || !result.Success {
+		t.Fatalf("Unexpected status response %+v (%v)", result, err)
+	}
+	if !report.Status.LocalConnected || len(report.Status.Remotes) != 1 || report.Heartbeat.DeviceID != "AirSENCE-Dummy" {
+		t.Fatalf("Unexpected status report:%+v", report)
+	}
+	result = sendCommand(t, handler, remote, Command{RequestID: "2", Token: "secret", Command: CommandConfig})
+	var conf config.Config
+	if err := json.Unmarshal(result.Data, &conf); err != nil || !result.Success {
+		t.Fatalf("Unexpected config response %+v (%v)", result, err)
+	}
+	if conf.Mqtt.Password != config.RedactedSecret || conf.Mqtt.CommandToken != config.RedactedSecret || conf.Mqtt.ClientID != "AirSENCE-Dummy" {
+		t.Fatalf("Expect secrets redacted, got %+v", conf.Mqtt)
+	}
+	if handler.config.Mqtt.Password != "password" {
+		t.Fatal("Redacting should not change the config of the handler")
+	}
+}
+
+func TestCommandSet(t *testing.T) {
+	handler, _, remote, _ := newCommandHandler(t)
+	UserConfigPath = filepath.Join(t.TempDir(), "config_user.toml")
+	defer func() { UserConfigPath = "" }()
+	user := "[server]\n\tLogRaw = true\n[mqtt]\n\tClientID = \"AirSENCE-Dummy\"\n\tRawTopic = \"airsence/AUG/+/raw\"\n"
+	if err := ioutil.WriteFile(UserConfigPath, []byte(user), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result := sendCommand(t, handler, remote, Command{
+		RequestID: "1",
+		Token:     "secret",
+		Command:   CommandSet,
+		Fields:    map[string]interface{}{"Server.LogRaw": false, "mqtt.resendbatchsize": 50},
+	})
+	if !result.Success {
+		t.Fatalf("Expect fields set, got %+v", result)
+	}
+	userconfig, err := config.ReadUserConf(UserConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userconfig.Server.LogRaw || userconfig.Mqtt.ResendBatchSize != 50 || userconfig.Mqtt.RawTopic != "airsence/AUG/+/raw" {
+		t.Fatalf("Unexpected user config file:%+v", userconfig)
+	}
+	if handler.config.Server.LogRaw || handler.config.Mqtt.ResendBatchSize != 50 {
+		t.Fatalf("Expect user config merged, got %+v", handler.config.Server)
+	}
+	result = sendCommand(t, handler, remote, Command{
+		RequestID: "2",
+		Token:     "secret",
+		Command:   CommandSet,
+		Fields:    map[string]interface{}{"Server.LogRaw": true, "Server.MainFolder": "/tmp"},
+	})
+	if result.Success {
+		t.Fatalf("Expect field not in user config rejected, got %+v", result)
+	}
+	if userconfig, _ = config.ReadUserConf(UserConfigPath); userconfig.Server.LogRaw {
+		t.Fatal("User config file should not change when any field is rejected")
+	}
+}
+
+func TestCommandSetStartOutbox(t *testing.T) {
+	handler, local, remote, _ := newCommandHandler(t)
+	defer close(handler.done)
+	UserConfigPath = filepath.Join(t.TempDir(), "config_user.toml")
+	defer func() { UserConfigPath = "" }()
+	user := "[server]\n\tLogRaw = true\n[mqtt]\n\tClientID = \"AirSENCE-Dummy\"\n\tRawTopic = \"airsence/AUG/+/raw\"\n"
+	if err := ioutil.WriteFile(UserConfigPath, []byte(user), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handler.config.Server.SendRawData = false
+	handler.startOutboxes()
+	raw, _ := msgpack.Marshal(RawDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: time.Now().Unix() - 100, RawData: map[string]float64{"CO": 0.3}})
+	local.Deliver(handler.RawTopic, raw)
+	topic := handler.Remotes[0].topic(RawTable)
+	if published := remote.Published(topic); len(published) != 0 {
+		t.Fatalf("Expect raw data not sent, got %v", published)
+	}
+
+	//The outbox runs as a job until done is closed, so the response is not waited for by sendCommand
+	remote.Deliver(handler.CommandTopic, []byte(`{"RequestID":"1","Token":"secret","Command":"set","Fields":{"Server.SendRawData":true}}`))
+	if published := remote.Published(handler.CommandTopic + "/response/1"); len(published) != 1 ||
+		!strings.Contains(string(published[0].payload), `"Success":true`) {
+		t.Fatalf("Expect field set, got %v", published)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(remote.Published(topic)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expect raw outbox started to send the unsent raw data")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandFlushAndPurge(t *testing.T) {
+	handler, local, remote, store := newCommandHandler(t)
+	ts := time.Now().Unix() - 100
+	old := time.Now().AddDate(0, 0, -10).Unix()
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(old))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	remote.SetPublishErr(nil)
+
+	result := sendCommand(t, handler, remote, Command{RequestID: "1", Token: "secret", Command: CommandFlush})
+	var results map[string]ResendResult
+	if err := json.Unmarshal(result.Data, &results); err != nil || !result.Success {
+		t.Fatalf("Unexpected flush response %+v (%v)", result, err)
+	}
+	if results[PollutantTable].Succeeded != 2 || results[PollutantTable].Remaining != 0 {
+		t.Fatalf("Expect 2 pollutant rows flushed, got %+v", results)
+	}
+	result = sendCommand(t, handler, remote, Command{RequestID: "2", Token: "secret", Command: CommandPurge})
+	if result.Success {
+		t.Fatalf("Expect purge without days rejected, got %+v", result)
+	}
+	result = sendCommand(t, handler, remote, Command{RequestID: "3", Token: "secret", Command: CommandPurge, Days: 7})
+	if !result.Success || string(result.Data) != "1" {
+		t.Fatalf("Expect 1 sample purged, got %+v", result)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts}); len(records) != 1 || records[0].Timestamp != ts {
+		t.Fatalf("Unexpected records after purge:%v", records)
+	}
+}
+
+func TestCommandRotateAndRestart(t *testing.T) {
+	handler, _, remote, store := newCommandHandler(t)
+	handler.recovery.fallback = store
+	result := sendCommand(t, handler, remote, Command{RequestID: "0", Token: "secret", Command: CommandRotate})
+	if result.Success || handler.Store() != store {
+		t.Fatalf("Expect rotate refused while the fallback store is in use, got %+v", result)
+	}
+	handler.recovery.fallback = nil
+
+	result = sendCommand(t, handler, remote, Command{RequestID: "1", Token: "secret", Command: CommandRotate})
+	if !result.Success {
+		t.Fatalf("Expect database rotated, got %+v", result)
+	}
+	sqliteStore, ok := handler.Store().(*SQLiteStore)
+	if !ok {
+		t.Fatalf("Expect SQLite store opened, got %T", handler.Store())
+	}
+	defer sqliteStore.Close()
+
+	online := len(remote.Published("airsence/AUG/AirSENCE-Dummy/will"))
+	handler.config.Mqtt.RawTopic = "airsence/AUG/+/rawdata"
+	result = sendCommand(t, handler, remote, Command{RequestID: "2", Token: "secret", Command: CommandRestart})
+	if !result.Success {
+		t.Fatalf("Expect pipeline restarted, got %+v", result)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(remote.Published("airsence/AUG/AirSENCE-Dummy/will")) == online {
+		if time.Now().After(deadline) {
+			t.Fatal("Expect remote reconnected after restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler.lock.RLock()
+	rawTopic := handler.RawTopic
+	handler.lock.RUnlock()
+	if rawTopic != "airsence/AUG/AirSENCE-Dummy/rawdata" {
+		t.Fatalf("Expect topics of current config applied, got %v", rawTopic)
+	}
+}
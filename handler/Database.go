@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+
+	"aws.airsence/datasync/config"
+)
+
+//pendingSample is a sample received while the database is unavailable
+type pendingSample struct {
+	table     string
+	timestamp int64
+	data      []byte
+	delivered []string
+	letter    *DeadLetter //letter is the quarantined message to save into the dead letters instead of a sample
+}
+
+//name describe the sample in logs, e.g. pollutant data or quarantined raw message
+func (sample pendingSample) name() string {
+	if sample.letter != nil {
+		return fmt.Sprintf("quarantined %v message", sample.table)
+	}
+	return fmt.Sprintf("%v data", sample.table)
+}
+
+//ringBuffer is a bounded FIFO of samples. When it is full, the oldest sample or the sample pushed is dropped
+type ringBuffer struct {
+	samples    []pendingSample
+	head       int //head is the index of the oldest sample
+	count      int
+	dropNewest bool  //dropNewest drop the sample pushed instead of the oldest one when the buffer is full
+	dropped    int64 //dropped is the number of samples dropped because the buffer is full
+}
+
+//push add the sample to the buffer and return the sample dropped, nil when the buffer is not full
+func (buffer *ringBuffer) push(sample pendingSample) *pendingSample {
+	if buffer.count == len(buffer.samples) {
+		buffer.dropped++
+		if buffer.dropNewest {
+			return &sample
+		}
+		oldest := buffer.samples[buffer.head]
+		buffer.samples[buffer.head] = sample
+		buffer.head = (buffer.head + 1) % len(buffer.samples)
+		return &oldest
+	}
+	buffer.samples[(buffer.head+buffer.count)%len(buffer.samples)] = sample
+	buffer.count++
+	return nil
+}
+
+//pushFront put the sample back as the oldest one, e.g. when it fails to be flushed, and return the sample dropped,
+//nil when the buffer is not full. When the buffer is full, the sample itself is the oldest one, or the newest is dropped
+func (buffer *ringBuffer) pushFront(sample pendingSample) *pendingSample {
+	var dropped *pendingSample
+	if buffer.count == len(buffer.samples) {
+		buffer.dropped++
+		if !buffer.dropNewest {
+			return &sample
+		}
+		tail := (buffer.head + buffer.count - 1) % len(buffer.samples)
+		newest := buffer.samples[tail]
+		dropped = &newest
+		buffer.count--
+	}
+	buffer.head = (buffer.head + len(buffer.samples) - 1) % len(buffer.samples)
+	buffer.samples[buffer.head] = sample
+	buffer.count++
+	return dropped
+}
+
+//pop remove the oldest sample from the buffer, false when the buffer is empty
+func (buffer *ringBuffer) pop() (pendingSample, bool) {
+	if buffer.count == 0 {
+		return pendingSample{}, false
+	}
+	sample := buffer.samples[buffer.head]
+	buffer.samples[buffer.head] = pendingSample{}
+	buffer.head = (buffer.head + 1) % len(buffer.samples)
+	buffer.count--
+	return sample, true
+}
+
+//Database manage the lifecycle of the store. The store is opened by a single goroutine at a time, and samples
+//which cannot be saved, because the store is not open yet or fails to insert, are buffered in memory up to
+//the capacity until they are flushed into the store
+type Database struct {
+	lock     sync.Mutex
+	flushing sync.Mutex   //flushing is held while the buffer is flushed into the store
+	saving   sync.RWMutex //saving is read locked while a sample is saved, so Set can wait for the saves into the previous store
+	store    Store
+	ready    chan struct{} //ready is closed when the store is open
+	opening  bool          //opening is true while a goroutine is opening the store
+	buffer   ringBuffer
+}
+
+//NewDatabase create the database without store, buffering up to capacity samples. When the buffer is full,
+//the oldest sample is dropped unless overflow is config.BufferDropNewest
+func NewDatabase(capacity int, overflow string) *Database {
+	if capacity <= 0 {
+		capacity = config.DefaultBufferSize
+	}
+	return &Database{
+		ready: make(chan struct{}),
+		buffer: ringBuffer{
+			samples:    make([]pendingSample, capacity),
+			dropNewest: overflow == config.BufferDropNewest,
+		},
+	}
+}
+
+//Store return the store, nil when the database is not ready
+func (database *Database) Store() Store {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.store
+}
+
+//Ready return the channel closed when the store is open. A new channel is returned after the store is closed
+func (database *Database) Ready() <-chan struct{} {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.ready
+}
+
+//Set replace the store and return the previous one, which is not closed. It waits for the samples being saved
+//into the previous store, so the previous store can be closed without losing them. The buffer is not flushed
+func (database *Database) Set(store Store) Store {
+	database.lock.Lock()
+	previous := database.set(store)
+	database.lock.Unlock()
+	database.saving.Lock()
+	database.saving.Unlock()
+	return previous
+}
+
+//set replace the store and signal the readiness, the lock should be held
+func (database *Database) set(store Store) Store {
+	previous := database.store
+	database.store = store
+	if store != nil && previous == nil {
+		close(database.ready)
+	} else if store == nil && previous != nil {
+		database.ready = make(chan struct{})
+	}
+	return previous
+}
+
+//startOpening check whether the store should be opened, which is when it is not open and nobody is opening it.
+//The caller which gets true should call opened or stopOpening when it is done
+func (database *Database) startOpening() bool {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	if database.store != nil || database.opening {
+		return false
+	}
+	database.opening = true
+	return true
+}
+
+//stopOpening give up opening the store, e.g. when the service is shutting down
+func (database *Database) stopOpening() {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.opening = false
+}
+
+//opened set the store opened. It returns false when another store is already open, the store opened should
+//then be closed by the caller
+func (database *Database) opened(store Store) bool {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	database.opening = false
+	if database.store != nil {
+		return false
+	}
+	database.set(store)
+	return true
+}
+
+//storeOrBuffer return the store when it is ready, otherwise the sample is buffered and the sample dropped
+//from the buffer is returned, nil when nothing is dropped
+func (database *Database) storeOrBuffer(sample pendingSample) (Store, *pendingSample) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	if database.store != nil {
+		return database.store, nil
+	}
+	return nil, database.buffer.push(sample)
+}
+
+//bufferSample buffer the sample and return the sample dropped from the buffer, nil when nothing is dropped
+func (database *Database) bufferSample(sample pendingSample) *pendingSample {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.buffer.push(sample)
+}
+
+//requeue put the sample failed to be flushed back as the oldest one and return the sample dropped from the buffer,
+//nil when nothing is dropped
+func (database *Database) requeue(sample pendingSample) *pendingSample {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.buffer.pushFront(sample)
+}
+
+//pop remove the oldest sample from the buffer, false when the buffer is empty
+func (database *Database) pop() (pendingSample, bool) {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.buffer.pop()
+}
+
+//Buffered return the number of samples buffered in memory
+func (database *Database) Buffered() int {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.buffer.count
+}
+
+//Dropped return the number of samples dropped because the buffer is full
+func (database *Database) Dropped() int64 {
+	database.lock.Lock()
+	defer database.lock.Unlock()
+	return database.buffer.dropped
+}
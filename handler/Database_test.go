@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+//failingStore is a MemoryStore failing to insert while err is set, like a read-only SD card
+type failingStore struct {
+	*MemoryStore
+	lock sync.Mutex
+	err  error
+}
+
+func (store *failingStore) Insert(table string, timestamp int64, data []byte, delivered []string) error {
+	store.lock.Lock()
+	err := store.err
+	store.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return store.MemoryStore.Insert(table, timestamp, data, delivered)
+}
+
+func (store *failingStore) setErr(err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.err = err
+}
+
+func TestRingBuffer(t *testing.T) {
+	for _, test := range []struct {
+		overflow string
+		dropped  int64
+		kept     []int64
+	}{
+		{config.BufferDropOldest, 0, []int64{1, 2, 3}},
+		{config.BufferDropNewest, 3, []int64{0, 1, 2}},
+	} {
+		database := NewDatabase(3, test.overflow)
+		for i := int64(0); i < 3; i++ {
+			if dropped := database.bufferSample(pendingSample{timestamp: i}); dropped != nil {
+				t.Fatalf("Unexpected sample dropped before the buffer is full:%v", dropped)
+			}
+		}
+		if dropped := database.bufferSample(pendingSample{timestamp: 3}); dropped == nil || dropped.timestamp != test.dropped {
+			t.Fatalf("Expect sample %v dropped with %v policy, got %v", test.dropped, test.overflow, dropped)
+		}
+		for _, ts := range test.kept {
+			if sample, ok := database.pop(); !ok || sample.timestamp != ts {
+				t.Fatalf("Expect sample %v kept with %v policy, got %v", ts, test.overflow, sample)
+			}
+		}
+		if _, ok := database.pop(); ok || database.Dropped() != 1 || database.Buffered() != 0 {
+			t.Fatalf("Expect empty buffer with 1 sample dropped, got %v dropped", database.Dropped())
+		}
+	}
+}
+
+func TestRingBufferRequeue(t *testing.T) {
+	for _, test := range []struct {
+		overflow string
+		dropped  int64
+		kept     []int64
+	}{
+		{config.BufferDropOldest, 0, []int64{1, 2}},
+		{config.BufferDropNewest, 2, []int64{0, 1}},
+	} {
+		database := NewDatabase(2, test.overflow)
+		database.bufferSample(pendingSample{timestamp: 0})
+		database.bufferSample(pendingSample{timestamp: 1})
+		sample, _ := database.pop()
+		database.bufferSample(pendingSample{timestamp: 2})
+		//The sample failed to be flushed is older than every sample buffered meanwhile
+		if dropped := database.requeue(sample); dropped == nil || dropped.timestamp != test.dropped {
+			t.Fatalf("Expect sample %v dropped with %v policy, got %v", test.dropped, test.overflow, dropped)
+		}
+		for _, ts := range test.kept {
+			if sample, ok := database.pop(); !ok || sample.timestamp != ts {
+				t.Fatalf("Expect sample %v kept in order with %v policy, got %v", ts, test.overflow, sample)
+			}
+		}
+	}
+	database := NewDatabase(3, config.BufferDropOldest)
+	database.bufferSample(pendingSample{timestamp: 1})
+	if dropped := database.requeue(pendingSample{timestamp: 0}); dropped != nil {
+		t.Fatalf("Unexpected sample dropped before the buffer is full:%v", dropped)
+	}
+	for _, ts := range []int64{0, 1} {
+		if sample, ok := database.pop(); !ok || sample.timestamp != ts {
+			t.Fatalf("Expect sample %v put back as the oldest, got %v", ts, sample)
+		}
+	}
+}
+
+func TestDatabaseLifecycle(t *testing.T) {
+	database := NewDatabase(2, config.BufferDropOldest)
+	ready := database.Ready()
+	if !database.startOpening() || database.startOpening() {
+		t.Fatal("Expect only one goroutine opening the store")
+	}
+	if store, dropped := database.storeOrBuffer(pendingSample{table: PollutantTable}); store != nil || dropped != nil {
+		t.Fatalf("Expect sample buffered, got %v (%v dropped)", store, dropped)
+	}
+	select {
+	case <-ready:
+		t.Fatal("Database should not be ready before the store is open")
+	default:
+	}
+
+	store := NewMemoryStore()
+	if !database.opened(store) || database.Buffered() != 1 {
+		t.Fatal("Expect store opened with the sample still buffered")
+	}
+	<-ready
+	if database.opened(NewMemoryStore()) || database.startOpening() {
+		t.Fatal("Store should not be opened again while it is open")
+	}
+	if database.Set(nil) != store {
+		t.Fatal("Expect the previous store returned")
+	}
+	select {
+	case <-database.Ready():
+		t.Fatal("Database should not be ready after the store is closed")
+	default:
+	}
+}
+
+func TestBufferUntilDatabaseReady(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	if _, err := handler.Remotes[0].pollutantOutbox.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	handler.SetStore(nil)
+	//Hold the opening, as if the clock is not synchronized yet
+	if !handler.db.startOpening() {
+		t.Fatal("Expect database to be opened")
+	}
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	for i := int64(0); i < 3; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	remote.SetPublishErr(nil)
+	if handler.db.Buffered() != 3 || handler.Store() != nil {
+		t.Fatalf("Expect 3 samples buffered, got %v", handler.db.Buffered())
+	}
+
+	handler.storeOpened(store)
+	select {
+	case <-handler.DatabaseReady():
+	case <-time.After(time.Second):
+		t.Fatal("Expect database ready")
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10, Unsent: config.DefaultRemoteName}); len(records) != 3 {
+		t.Fatalf("Expect buffered samples saved as unsent, got %v", records)
+	}
+	if cursor := handler.Remotes[0].pollutantOutbox.Cursor(); cursor != ts {
+		t.Fatalf("Expect outbox notified of the buffered samples, cursor %v", cursor)
+	}
+	if snapshot := handler.metricsSnapshot(); snapshot.Saved[PollutantTable] != 3 || snapshot.Buffered != 0 {
+		t.Fatalf("Expect 3 samples saved, got %v", snapshot.Saved)
+	}
+}
+
+func TestBufferWhenInsertFails(t *testing.T) {
+	handler, local, _, _ := newTestHandler(t)
+	handler.db = NewDatabase(2, config.BufferDropOldest)
+	store := &failingStore{MemoryStore: NewMemoryStore(config.DefaultRemoteName), err: fmt.Errorf("read-only file system")}
+	handler.SetStore(store)
+	ts := time.Now().Unix() - 100
+	for i := int64(0); i < 3; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	snapshot := handler.metricsSnapshot()
+	if snapshot.Buffered != 2 || snapshot.BufferDropped != 1 || snapshot.SaveFailed[PollutantTable] != 1 {
+		t.Fatalf("Expect 2 samples buffered and the oldest dropped, got %+v", snapshot)
+	}
+
+	store.setErr(nil)
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+3))
+	records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10})
+	if len(records) != 3 || records[0].Timestamp != ts+1 || handler.db.Buffered() != 0 {
+		t.Fatalf("Expect buffered samples flushed after the next sample is saved, got %v", records)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package handler
+
+import "syscall"
+
+//diskFree return the number of bytes available to the service in the file system of the folder
+func diskFree(folder string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(folder, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+//valuesTableStmt create the long-format table with one row for each key of the pollutant (or raw) data of a sample
+const valuesTableStmt = `
+	create table if not exists sample_values (tbl text not null, id integer not null, key text not null, value real, primary key(tbl,id,key));
+	`
+
+//valuesKeyIndexStmt create the index for selecting samples by key
+const valuesKeyIndexStmt = `
+	create index if not exists sample_values_key on sample_values (tbl, key, id);
+	`
+
+//fieldColumns are the columns of each table for the fields decoded from the samples
+var fieldColumns = map[string][]string{
+	RawTable:       {"device_id text"},
+	PollutantTable: {"device_id text", "latitude real", "longitude real"},
+}
+
+//sampleFields are the fields of a msgpack sample which are stored as queryable columns besides the original
+//payload, which is kept for byte-exact resend
+type sampleFields struct {
+	DeviceID      string
+	Timestamp     int64
+	GPS           map[string]float64
+	RawData       map[string]float64
+	PollutantData map[string]float64
+}
+
+//decodeFields decode the fields of the msgpack sample, false when it is not a msgpack sample
+func decodeFields(data []byte) (sampleFields, bool) {
+	var fields sampleFields
+	if err := msgpack.Unmarshal(data, &fields); err != nil {
+		return fields, false
+	}
+	return fields, true
+}
+
+//values return the pollutant data of the sample, or the raw data for raw table
+func (fields sampleFields) values(table string) map[string]float64 {
+	if table == RawTable {
+		return fields.RawData
+	}
+	return fields.PollutantData
+}
+
+//gps return the coordinate of the key in GPS, null when there is no such key
+func (fields sampleFields) gps(key string) sql.NullFloat64 {
+	value, ok := fields.GPS[key]
+	return sql.NullFloat64{Float64: value, Valid: ok}
+}
+
+//hasKeys check whether the sample of the table has any of the keys in its pollutant (or raw) data
+func hasKeys(table string, data []byte, keys []string) bool {
+	fields, ok := decodeFields(data)
+	if !ok {
+		return false
+	}
+	values := fields.values(table)
+	for _, key := range keys {
+		if _, ok := values[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+//insertFields decode the sample with the id and save its fields into the columns of the table and its values
+//into the sample_values table. Nothing is saved for a sample which is not msgpack
+func insertFields(tx *sql.Tx, table string, id int64, data []byte) error {
+	fields, ok := decodeFields(data)
+	if !ok {
+		return nil
+	}
+	var err error
+	if table == PollutantTable {
+		_, err = tx.Exec(
+			`update pollutant set device_id = ?, latitude = ?, longitude = ? where id = ?`,
+			fields.DeviceID,
+			fields.gps("Latitude"),
+			fields.gps("Longitude"),
+			id,
+		)
+	} else {
+		_, err = tx.Exec(fmt.Sprintf(`update %v set device_id = ? where id = ?`, table), fields.DeviceID, id)
+	}
+	if err != nil {
+		return err
+	}
+	for key, value := range fields.values(table) {
+		if _, err = tx.Exec(`insert or replace into sample_values(tbl,id,key,value) values (?,?,?,?)`, table, id, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//backfillTableStmt create the table of the progress of saving the fields of the samples inserted before
+//migration 2. For each table, the samples after next up to last are still to be done
+const backfillTableStmt = `
+	create table if not exists backfill (tbl text not null primary key, next integer not null, last integer not null);
+	`
+
+//backfillChunkSize is the number of samples of each table whose fields are saved in one transaction
+const backfillChunkSize = 1000
+
+//scheduleBackfill save the progress of the table into the backfill table, so the fields of the samples already
+//in the table are saved by backfillFields later instead of in the migration
+func scheduleBackfill(tx *sql.Tx, table string) error {
+	var last sql.NullInt64
+	if err := tx.QueryRow(fmt.Sprintf(`select max(id) from %v`, table)).Scan(&last); err != nil || !last.Valid {
+		return err
+	}
+	if _, err := tx.Exec(backfillTableStmt); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`insert or replace into backfill(tbl,next,last) values (?,0,?)`, table, last.Int64)
+	return err
+}
+
+//backfillFields save the fields of the next chunk of samples of every table in the backfill table and return
+//true when there are more samples to do. The backfill table is dropped once every sample is done
+func backfillFields(tx *sql.Tx) (bool, error) {
+	rows, err := tx.Query(`select tbl,next,last from backfill`)
+	if err != nil {
+		return false, err
+	}
+	type progress struct {
+		table string
+		next  int64
+		last  int64
+	}
+	var tables []progress
+	for rows.Next() {
+		var table progress
+		if err = rows.Scan(&table.table, &table.next, &table.last); err != nil {
+			rows.Close()
+			return false, err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+	more := false
+	for _, table := range tables {
+		records, err := backfillChunk(tx, table.table, table.next, table.last)
+		if err != nil {
+			return false, err
+		}
+		if len(records) == 0 {
+			if _, err = tx.Exec(`delete from backfill where tbl = ?`, table.table); err != nil {
+				return false, err
+			}
+			continue
+		}
+		for _, record := range records {
+			if err = insertFields(tx, table.table, record.ID, record.Data); err != nil {
+				return false, err
+			}
+		}
+		if _, err = tx.Exec(`update backfill set next = ? where tbl = ?`, records[len(records)-1].ID, table.table); err != nil {
+			return false, err
+		}
+		more = true
+	}
+	if !more {
+		_, err = tx.Exec(`drop table backfill`)
+	}
+	return more, err
+}
+
+//backfillChunk return the next chunk of samples of the table with ID after next up to last
+func backfillChunk(tx *sql.Tx, table string, next int64, last int64) ([]Record, error) {
+	rows, err := tx.Query(
+		fmt.Sprintf(`select id,data from %v where id > ? and id <= ? order by id limit ?`, table),
+		next,
+		last,
+		backfillChunkSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var record Record
+		if err = rows.Scan(&record.ID, &record.Data); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+//startBackfill save the fields of the samples of the database file inserted before migration 2 in background,
+//unless it is being done already
+func (store *SQLiteStore) startBackfill(path string) {
+	store.backfillLock.Lock()
+	defer store.backfillLock.Unlock()
+	if store.backfilling == nil {
+		store.backfilling = make(map[string]bool)
+	}
+	if store.backfilling[path] {
+		return
+	}
+	store.backfilling[path] = true
+	store.backfills.Add(1)
+	go store.backfill(path)
+}
+
+//backfill save the fields of the samples of the database file a chunk at a time, each in its own transaction with
+//the read lock held, so samples keep being inserted meanwhile and the file is not removed by purge in between.
+//It stops when the store is closed or the file is removed, and resumes when the file is opened again
+func (store *SQLiteStore) backfill(path string) {
+	defer func() {
+		store.backfillLock.Lock()
+		delete(store.backfilling, path)
+		store.backfillLock.Unlock()
+		store.backfills.Done()
+	}()
+	for {
+		more, err := store.backfillOnce(path)
+		if err != nil {
+			store.logger.Errorf("Unable to save fields of samples in %v:%v", filepath.Base(path), err)
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+//backfillOnce save the fields of the next chunk of samples of the database file and return true when there are more
+func (store *SQLiteStore) backfillOnce(path string) (bool, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if store.closed {
+		return false, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%v?cache=shared&mode=rw&_journal_mode=WAL", path))
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	more, err := backfillFields(tx)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	if !more {
+		store.logger.Infof("Saved fields of every sample in %v", filepath.Base(path))
+	}
+	return more, nil
+}
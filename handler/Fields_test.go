@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+//testKeys check the samples are selected by the keys of their pollutant (or raw) data
+func testKeys(t *testing.T, store Store) {
+	ts := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	raw, _ := msgpack.Marshal(RawDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts, RawData: map[string]float64{"CO": 0.3}})
+	for _, insert := range []struct {
+		table string
+		data  []byte
+	}{{PollutantTable, pollutantPayload(ts)}, {PollutantTable, []byte{0x80}}, {RawTable, raw}} {
+		if err := store.Insert(insert.table, ts, insert.data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		table    string
+		keys     []string
+		expected int
+	}{
+		{PollutantTable, nil, 2},
+		{PollutantTable, []string{"NO2"}, 1},
+		{PollutantTable, []string{"O3", "NO"}, 1},
+		{PollutantTable, []string{"CO"}, 0},
+		{RawTable, []string{"CO"}, 1},
+	} {
+		records, err := store.Find(Filter{Table: test.table, StartDate: ts, EndDate: ts, Keys: test.keys})
+		if err != nil || len(records) != test.expected {
+			t.Fatalf("Expect %v %v samples with %v, got %v (%v)", test.expected, test.table, test.keys, records, err)
+		}
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	testKeys(t, NewMemoryStore("cloud"))
+}
+
+func TestSQLiteStoreFields(t *testing.T) {
+	store, err := NewSQLiteStore(t.TempDir(), "AirSENCE-Dummy", []string{"cloud"}, testLogger(), time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testKeys(t, store)
+
+	db, err := sql.Open("sqlite3", store.dbPath("202204"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var deviceID string
+	var latitude, longitude, no2 float64
+	err = db.QueryRow(`
+	select device_id, latitude, longitude, value from pollutant join sample_values on sample_values.id = pollutant.id
+	where tbl = 'pollutant' and key = 'NO2'
+	`).Scan(&deviceID, &latitude, &longitude, &no2)
+	if err != nil || deviceID != "AirSENCE-Dummy" || latitude != -79 || longitude != 41 || no2 != 2.5 {
+		t.Fatalf("Unexpected fields %v %v %v %v (%v)", deviceID, latitude, longitude, no2, err)
+	}
+	ts := time.Date(2022, 4, 16, 0, 0, 0, 0, time.UTC).Unix()
+	payload := pollutantPayload(ts)
+	if err = store.Insert(PollutantTable, ts, payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, StartDate: ts, EndDate: ts}); len(records) != 1 || string(records[0].Data) != string(payload) {
+		t.Fatal("Expect the original payload kept for resend")
+	}
+
+	if _, err = store.Purge(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	var values int
+	if err = db.QueryRow(`select count(*) from sample_values`).Scan(&values); err != nil || values != 0 {
+		t.Fatalf("Expect values of purged samples deleted, got %v (%v)", values, err)
+	}
+}
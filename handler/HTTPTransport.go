@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"aws.airsence/datasync/config"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	httpTimeout = 10 * time.Second //httpTimeout is the timeout of one request to the HTTP endpoint
+)
+
+//BatchPublisher is a Publisher which is able to deliver several payloads to a topic in one request.
+//Either every payload is delivered or none of them is
+type BatchPublisher interface {
+	PublishBatch(topic string, qos byte, payloads [][]byte) error
+}
+
+//HTTPTransport is the Transport which posts payloads to a HTTP(S) endpoint, for networks where the remote
+//MQTT broker is not reachable. The topic is appended to the endpoint URL as the path to post to.
+//It does not receive messages, so subscriptions are ignored
+type HTTPTransport struct {
+	endpoint  string
+	format    string
+	token     string
+	client    *http.Client
+	onConnect func(Transport)
+	onLost    func(Transport, error)
+}
+
+//NewHTTPTransport create a HTTPTransport posting to the endpoint in the format (msgpack or json).
+//The token is sent as bearer token when it is not empty, and the TLS config is used for mTLS
+func NewHTTPTransport(endpoint string, format string, token string, tlsConfig *tls.Config) (*HTTPTransport, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("No URL configured for HTTP transport")
+	}
+	if format != config.FormatMsgpack && format != config.FormatJSON {
+		return nil, fmt.Errorf("Unknown format %v for HTTP transport", format)
+	}
+	return &HTTPTransport{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		format:   format,
+		token:    token,
+		client: &http.Client{
+			Timeout:   httpTimeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+	}, nil
+}
+
+//SetConnectionHandlers set the callbacks for connection established and connection lost
+func (transport *HTTPTransport) SetConnectionHandlers(onConnect func(Transport), onLost func(Transport, error)) {
+	transport.onConnect = onConnect
+	transport.onLost = onLost
+}
+
+//Connect does not open any connection since every request has its own, it only calls the connection
+//established callback so unsent rows are drained
+func (transport *HTTPTransport) Connect() error {
+	if transport.onConnect != nil {
+		transport.onConnect(transport)
+	}
+	return nil
+}
+
+//Disconnect close the idle connections with the endpoint
+func (transport *HTTPTransport) Disconnect() {
+	transport.client.CloseIdleConnections()
+}
+
+//Subscribe is not supported by HTTP endpoint and does nothing
+func (transport *HTTPTransport) Subscribe(topic string, qos byte, callback MessageHandler) error {
+	return nil
+}
+
+//Publish post the payload to the topic of the endpoint
+func (transport *HTTPTransport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	body := payload
+	if transport.format == config.FormatJSON {
+		var err error
+		if body, err = msgpackToJSON(payload); err != nil {
+			return err
+		}
+	}
+	return transport.post(topic, body)
+}
+
+//PublishBatch post the payloads to the topic of the endpoint in one request, as a msgpack or json array
+func (transport *HTTPTransport) PublishBatch(topic string, qos byte, payloads [][]byte) error {
+	var body bytes.Buffer
+	if transport.format == config.FormatJSON {
+		body.WriteByte('[')
+		for i, payload := range payloads {
+			data, err := msgpackToJSON(payload)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(data)
+		}
+		body.WriteByte(']')
+	} else {
+		if err := msgpack.NewEncoder(&body).EncodeArrayLen(len(payloads)); err != nil {
+			return err
+		}
+		for _, payload := range payloads {
+			body.Write(payload)
+		}
+	}
+	return transport.post(topic, body.Bytes())
+}
+
+//post send the body to the topic of the endpoint. Any status other than 2xx is an error
+func (transport *HTTPTransport) post(topic string, body []byte) error {
+	url := transport.endpoint + "/" + strings.TrimPrefix(topic, "/")
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if transport.format == config.FormatJSON {
+		request.Header.Set("Content-Type", "application/json")
+	} else {
+		request.Header.Set("Content-Type", "application/msgpack")
+	}
+	if transport.token != "" {
+		request.Header.Set("Authorization", "Bearer "+transport.token)
+	}
+	response, err := transport.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Error when post to %v:%v", url, response.Status)
+	}
+	return nil
+}
+
+//msgpackToJSON convert the msgpack payload to JSON
+func msgpackToJSON(payload []byte) ([]byte, error) {
+	var data interface{}
+	if err := msgpack.Unmarshal(payload, &data); err != nil {
+		return nil, fmt.Errorf("Unable to decode payload:%v", err)
+	}
+	return json.Marshal(data)
+}
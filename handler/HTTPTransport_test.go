@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+	"github.com/vmihailenco/msgpack"
+)
+
+//httpRequest is a request received by the test endpoint
+type httpRequest struct {
+	path          string
+	contentType   string
+	authorization string
+	body          []byte
+}
+
+//testEndpoint is a HTTP handler which records every request and responds with the status
+type testEndpoint struct {
+	lock     sync.Mutex
+	status   int
+	requests []httpRequest
+}
+
+func (endpoint *testEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	endpoint.requests = append(endpoint.requests, httpRequest{
+		path:          r.URL.Path,
+		contentType:   r.Header.Get("Content-Type"),
+		authorization: r.Header.Get("Authorization"),
+		body:          body,
+	})
+	w.WriteHeader(endpoint.status)
+}
+
+func (endpoint *testEndpoint) SetStatus(status int) {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	endpoint.status = status
+}
+
+func (endpoint *testEndpoint) Requests() []httpRequest {
+	endpoint.lock.Lock()
+	defer endpoint.lock.Unlock()
+	return append([]httpRequest(nil), endpoint.requests...)
+}
+
+func TestHTTPTransportPublish(t *testing.T) {
+	endpoint := &testEndpoint{status: http.StatusOK}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	if _, err := NewHTTPTransport(server.URL, "xml", "", nil); err == nil {
+		t.Fatal("Expect error for unknown format")
+	}
+	transport, err := NewHTTPTransport(server.URL+"/ingest/", config.FormatJSON, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = transport.Publish("airsence/AUG/AirSENCE-Dummy/pollutant", 0, false, pollutantPayload(1650000000)); err != nil {
+		t.Fatal(err)
+	}
+	requests := endpoint.Requests()
+	if len(requests) != 1 ||
+		requests[0].path != "/ingest/airsence/AUG/AirSENCE-Dummy/pollutant" ||
+		requests[0].contentType != "application/json" ||
+		requests[0].authorization != "Bearer secret" {
+		t.Fatalf("Unexpected request:%+v", requests)
+	}
+	var data PollutantDataMsgPack
+	if err = json.Unmarshal(requests[0].body, &data); err != nil || data.Timestamp != 1650000000 || data.PollutantData["NO2"] != 2.5 {
+		t.Fatalf("Unexpected JSON body %s (%v)", requests[0].body, err)
+	}
+
+	transport, err = NewHTTPTransport(server.URL, config.FormatMsgpack, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = transport.PublishBatch("pollutant", 0, [][]byte{pollutantPayload(1), pollutantPayload(2)}); err != nil {
+		t.Fatal(err)
+	}
+	requests = endpoint.Requests()
+	var batch []PollutantDataMsgPack
+	if err = msgpack.Unmarshal(requests[1].body, &batch); err != nil || len(batch) != 2 || batch[1].Timestamp != 2 {
+		t.Fatalf("Unexpected msgpack batch %v (%v)", batch, err)
+	}
+	if requests[1].contentType != "application/msgpack" || requests[1].authorization != "" {
+		t.Fatalf("Unexpected request:%+v", requests[1])
+	}
+
+	endpoint.SetStatus(http.StatusServiceUnavailable)
+	if err = transport.Publish("pollutant", 0, false, pollutantPayload(3)); err == nil {
+		t.Fatal("Expect error when endpoint responds with 503")
+	}
+}
+
+func TestHTTPTransportMutualTLS(t *testing.T) {
+	endpoint := &testEndpoint{status: http.StatusOK}
+	server := httptest.NewUnstartedServer(endpoint)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "AirSENCE-Dummy"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := t.TempDir()
+	certFile := filepath.Join(folder, "certificate.pem.crt")
+	keyFile := filepath.Join(folder, "private.pem.key")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	noCert, err := NewHTTPTransport(server.URL, config.FormatMsgpack, "", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = noCert.Publish("pollutant", 0, false, pollutantPayload(1)); err == nil {
+		t.Fatal("Expect error without client certificate")
+	}
+	tlsConfig, err := newTLSConfig("", certFile, keyFile, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewHTTPTransport(server.URL, config.FormatMsgpack, "", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = transport.Publish("pollutant", 0, false, pollutantPayload(1)); err != nil {
+		t.Fatalf("Expect publish with client certificate, got %v", err)
+	}
+}
+
+func TestHTTPRemoteResend(t *testing.T) {
+	endpoint := &testEndpoint{status: http.StatusBadGateway}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+	conf := config.Config{}
+	conf.Server.LogPollutant = true
+	conf.Server.SendPollutantData = true
+	conf.Mqtt.ClientID = "AirSENCE-Dummy"
+	conf.Mqtt.PollutantTopic = "airsence/AUG/+/pollutant"
+	conf.Remote = []config.RemoteConfig{{Name: "https", Type: config.RemoteTypeHTTP, URL: server.URL, BatchSize: 2}}
+	transport, err := newRemoteTransport(conf.Remotes()[0], conf.Mqtt.ClientID, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := newFakeTransport()
+	store := NewMemoryStore(conf.RemoteNames()...)
+	handler := NewHandler(conf, make(chan bool), testLogger(), local, map[string]Transport{"https": transport})
+	handler.SetStore(store)
+	if err = local.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err = transport.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Now().Unix() - 100
+	for i := int64(0); i < 3; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	if count, _ := store.CountUnsent("https", PollutantTable, 0, ts+10); count != 3 {
+		t.Fatalf("Expect 3 rows unsent while endpoint is down, got %v", count)
+	}
+
+	endpoint.SetStatus(http.StatusNoContent)
+	if sent, err := handler.Remotes[0].pollutantOutbox.Drain(); err != nil || sent != 3 {
+		t.Fatalf("Expect outbox to resend 3 rows, got %v (%v)", sent, err)
+	}
+	requests := endpoint.Requests()[3:]
+	if len(requests) != 2 {
+		t.Fatalf("Expect 3 rows resent in 2 requests, got %v", len(requests))
+	}
+	var batch []PollutantDataMsgPack
+	if err = msgpack.Unmarshal(requests[0].body, &batch); err != nil || len(batch) != 2 || batch[0].Timestamp != ts {
+		t.Fatalf("Unexpected first batch %v (%v)", batch, err)
+	}
+	if requests[1].path != fmt.Sprintf("/airsence/AUG/%v/pollutant", conf.Mqtt.ClientID) {
+		t.Fatalf("Unexpected path %v", requests[1].path)
+	}
+	if count, _ := store.CountUnsent("https", PollutantTable, 0, ts+10); count != 0 {
+		t.Fatalf("Expect every row sent, got %v unsent", count)
+	}
+}
@@ -1,38 +1,52 @@
 package handler
 
 import (
-	"crypto/tls"
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
-	"os/exec"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"aws.airsence/datasync/config"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
-	"github.com/vmihailenco/msgpack"
 )
 
 var (
-	DATE = "2021-04-01T00:00:00+00:00" //This date is for checking whether the machine is sychronized or not
+	DATE    = "2021-04-01T00:00:00+00:00" //This date is for checking whether the machine is sychronized or not
+	Version = ""                          //Version of the software reported in heartbeat, which is set by main
+	//UserConfigPath is the path of the user config file which the set command writes to, which is set by main
+	UserConfigPath = ""
 )
 
+//Handler forward samples from local MQTT broker to the remotes and keep them in the store.
+//Callbacks of the transports, the outboxes and commands run in their own goroutines, so config,
+//localConnected, stopping and the topics are guarded by lock and should be accessed by conf, isLocalConnected and
+//commandTopic, or with lock held
 type Handler struct {
+	lock                 sync.RWMutex
 	config               config.Config
 	MainLogger           *logrus.Logger
 	done                 chan bool
-	RemoteMqttClient     mqtt.Client
-	LocalMqttClient      mqtt.Client
-	DB                   *sql.DB
-	remoteMqttConnected  bool
+	Remotes              []*Remote
+	LocalMqttClient      Transport
+	localConnected       bool
+	db                   *Database
+	purges               purgeLog
+	recovery             recovery
+	runner               CommandRunner //runner runs the recovery commands
+	Metrics              *Metrics
+	started              time.Time
+	version              string         //version of the software reported in heartbeat, which is Version when created
+	jobs                 sync.WaitGroup //jobs are the goroutines running in background, e.g. outboxes and resends
+	stopping             bool           //stopping is true once Run stops starting jobs for shutting down
 	RawTopic             string
 	PollutantTopic       string
 	ResendRawTopic       string
 	ResendPollutantTopic string
+	CommandTopic         string
 }
 
 type RawDataMsgPack struct {
@@ -49,557 +63,975 @@ type PollutantDataMsgPack struct {
 }
 
 type ResendRequest struct {
-	StartDate int64
-	EndDate   int64
+	RequestID   string //RequestID is echoed in the response to correlate it with the request
+	StartDate   int64
+	EndDate     int64
+	Destination string   //Destination is the name of the remote to resend to, every remote when empty
+	IncludeSent bool     //IncludeSent replay samples already delivered as well, e.g. when they are lost downstream
+	Limit       int      //Limit is the maximum number of samples resent to each remote, no limit when 0
+	Order       string   //Order is asc (oldest first, default) or desc (newest first)
+	Topic       string   //Topic override the topic of the remote, "+" is replaced by the client ID
+	Rate        float64  //Rate is the maximum number of samples sent per second, no throttle when 0
+	Keys        []string //Keys only select samples with any of the pollutant (or raw) keys, every sample when empty
+	DryRun      bool     //DryRun only count the samples which would be resent
 }
 
+//ResendResponse is the response of a resend request published to <resend topic>/response on the broker which the
+//request arrived on. Code is 200 when every row is resent, 400 for an invalid request, 502 when rows failed to be
+//published and 503 when the resend could not start, e.g. the remote or the database is not connected
+type ResendResponse struct {
+	Version   int                `json:"version"`
+	RequestID string             `json:"requestId"`
+	Success   bool               `json:"success"`
+	Code      int                `json:"code"`
+	Message   string             `json:"message"`
+	Table     string             `json:"table"`
+	StartDate int64              `json:"startDate"`
+	EndDate   int64              `json:"endDate"`
+	Attempted int                `json:"attempted"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Remaining int                `json:"remaining"`
+	Matched   int                `json:"matched"`
+	Files     []ResendFileResult `json:"files"`
+}
+
+//ResendFileResult is the number of rows resent from one partition of the store (monthly database file)
+type ResendFileResult struct {
+	File   string `json:"file"`
+	Resent int    `json:"resent"`
+}
+
+//ResendResult is the progress of a resend. Remaining is the number of rows still unsent in the time range
+type ResendResult struct {
+	Matched   int //Matched is the number of samples selected by the request, which are only counted in dry run
+	Attempted int
+	Succeeded int
+	Failed    int
+	Remaining int
+	Files     []ResendFileResult
+	failedAt  int64 //failedAt is the timestamp of the row failed to send
+}
+
+const (
+	defaultResendBatchSize = 100 //defaultResendBatchSize is used when ResendBatchSize is not configured
+	ResendResponseVersion  = 1   //ResendResponseVersion is the version of the ResendResponse schema
+	OrderAsc               = "asc"
+	OrderDesc              = "desc"
+)
+
+//InitHandler create the handler with paho MQTT clients for local and remote MQTT broker, connect to them
+//and initialize the database
 func InitHandler(
 	config config.Config,
 	done chan bool,
 	mainLogger *logrus.Logger,
 ) (handler *Handler) {
-	willPayload := strings.Replace(config.Mqtt.WillPayload, "+", config.Mqtt.ClientID, 1)
-	willTopic := strings.Replace(config.Mqtt.WillTopic, "+", config.Mqtt.ClientID, 1)
-	rawTopic := strings.Replace(config.Mqtt.RawTopic, "+", config.Mqtt.ClientID, 1)
-	pollutantTopic := strings.Replace(config.Mqtt.PollutantTopic, "+", config.Mqtt.ClientID, 1)
-	resendRawTopic := strings.Replace(config.Mqtt.ResendRawTopic, "+", config.Mqtt.ClientID, 1)
-	resendPollutantTopic := strings.Replace(config.Mqtt.ResendPollutantTopic, "+", config.Mqtt.ClientID, 1)
-	handler = &Handler{
-		config:               config,
-		done:                 done,
-		remoteMqttConnected:  false,
-		MainLogger:           mainLogger,
-		RawTopic:             rawTopic,
-		PollutantTopic:       pollutantTopic,
-		ResendRawTopic:       resendRawTopic,
-		ResendPollutantTopic: resendPollutantTopic,
-	}
 	//Initilize Local MQTT Client
 	optionsLocal := mqtt.NewClientOptions()
-	optionsLocal.AddBroker("127.0.0.1:1883")
-	optionsLocal.SetClientID(config.Mqtt.ClientID + "_DataSync")
-	optionsLocal.SetConnectionLostHandler(handler.lostConnectionHandlerLo)
-	optionsLocal.SetOnConnectHandler(handler.onConnectionHandlerLo)
-	clientLocal := mqtt.NewClient(optionsLocal)
-	handler.LocalMqttClient = clientLocal
-	token := clientLocal.Connect()
-	for !token.WaitTimeout(5 * time.Second) {
-	}
-	if token.Error() != nil {
-		err := token.Error()
+	for _, server := range config.LocalMqtt.ServerList() {
+		optionsLocal.AddBroker(server)
+	}
+	optionsLocal.SetClientID(config.Mqtt.ClientID + config.LocalMqtt.ClientIDSuffix)
+	optionsLocal.SetUsername(config.LocalMqtt.Username)
+	optionsLocal.SetPassword(config.LocalMqtt.Password)
+	tlsLocal, err := newTLSConfig(
+		config.LocalMqtt.CAFile,
+		config.LocalMqtt.CertFile,
+		config.LocalMqtt.KeyFile,
+		"",
+		false,
+	)
+	if err != nil {
+		mainLogger.Errorf("Error when try to get local MQTT credential file:%v", err)
+	} else if tlsLocal != nil {
+		optionsLocal.SetTLSConfig(tlsLocal)
+	}
+	clientLocal := NewPahoTransport(optionsLocal)
+
+	//Initilize Remote MQTT Clients
+	clientRemotes := make(map[string]Transport)
+	for _, remoteConfig := range config.Remotes() {
+		clientRemote, err := newRemoteTransport(remoteConfig, config.Mqtt.ClientID, mainLogger)
+		if err != nil {
+			mainLogger.Errorf("Unable to create client for remote %v:%v", remoteConfig.Name, err)
+			continue
+		}
+		clientRemotes[remoteConfig.Name] = clientRemote
+	}
+
+	handler = NewHandler(config, done, mainLogger, clientLocal, clientRemotes)
+	if err = clientLocal.Connect(); err != nil {
 		mainLogger.Errorf("Error when connect to local MQTT broker:%v", err)
 	}
+	for _, remote := range handler.Remotes {
+		if err = remote.Transport.Connect(); err != nil {
+			mainLogger.Errorf("Error when client connect to remote MQTT broker %v:%v", remote.Name, err)
+		}
+	}
+	handler.openDB()
+	return
+}
 
-	//Initilize Remote MQTT Client
-	cer, err := tls.LoadX509KeyPair(config.Mqtt.CertFile, config.Mqtt.KeyFile)
-	if err != nil {
-		mainLogger.Errorf("Error when try to get MQTT credential file:%v", err)
-	}
-	optionsRemote := mqtt.NewClientOptions()
-	optionsRemote.AddBroker(config.Mqtt.Servers)
-	optionsRemote.SetClientID(config.Mqtt.ClientID + "_DataSync")
-	optionsRemote.SetWill(willTopic, willPayload, config.Mqtt.Qos, false)
-	optionsRemote.SetKeepAlive(60 * time.Second)
-	optionsRemote.SetWriteTimeout(5 * time.Second)
-	optionsRemote.SetPingTimeout(3 * time.Second)
-	optionsRemote.SetConnectionLostHandler(handler.lostConnectionHandler)
-	optionsRemote.SetOnConnectHandler(handler.ontConnectionHandler)
-	optionsRemote.SetAutoReconnect(false)
-	optionsRemote.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cer}})
-	clientRemote := mqtt.NewClient(optionsRemote)
-	handler.RemoteMqttClient = clientRemote
-	token = clientRemote.Connect()
-	for !token.WaitTimeout(5 * time.Second) {
-	}
-	if token.Error() != nil {
-		err := token.Error()
-		mainLogger.Errorf("Error when client connect to remote MQTT broker:%v", err)
-	}
-	go handler.InitDB()
+//NewHandler create the handler with the transports for local MQTT broker and every remote destination,
+//remotes are keyed by the destination name. The transports are not connected and the store is not
+//initialized by NewHandler
+func NewHandler(
+	config config.Config,
+	done chan bool,
+	mainLogger *logrus.Logger,
+	local Transport,
+	remotes map[string]Transport,
+) (handler *Handler) {
+	handler = &Handler{
+		config:          config,
+		done:            done,
+		MainLogger:      mainLogger,
+		LocalMqttClient: local,
+		Metrics:         NewMetrics(),
+		db:              NewDatabase(config.Server.BufferSize, config.Server.BufferOverflow),
+		runner:          execRunner{},
+		started:         time.Now(),
+		version:         Version,
+	}
+	maxBackoff := time.Minute * time.Duration(config.Mqtt.ResendingInterval)
+	for _, remoteConfig := range config.Remotes() {
+		transport, ok := remotes[remoteConfig.Name]
+		if !ok {
+			mainLogger.Errorf("No MQTT client for remote %v", remoteConfig.Name)
+			continue
+		}
+		remote := newRemote(remoteConfig, config.Mqtt.ClientID, transport)
+		remote.rawOutbox = NewOutbox(handler, remote, RawTable, maxBackoff)
+		remote.pollutantOutbox = NewOutbox(handler, remote, PollutantTable, maxBackoff)
+		transport.SetConnectionHandlers(
+			func(transport Transport) {
+				handler.ontConnectionHandler(remote, transport)
+			},
+			func(transport Transport, err error) {
+				handler.lostConnectionHandler(remote, transport, err)
+			},
+		)
+		handler.Remotes = append(handler.Remotes, remote)
+	}
+	handler.applyTopics()
+	local.SetConnectionHandlers(handler.onConnectionHandlerLo, handler.lostConnectionHandlerLo)
 	return
 }
 
-//InitDB initialize DB connection
-func (handler *Handler) InitDB() {
-	var date, mileStoneTime time.Time
-	var db *sql.DB
-	var err error
-	mileStoneTime, _ = time.Parse(
-		time.RFC3339,
-		DATE,
-	)
+//conf return a copy of the config, which the set command may change at any time
+func (handler *Handler) conf() config.Config {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.config
+}
+
+//mergeUserConfig merge the user config into the config of the handler
+func (handler *Handler) mergeUserConfig(userconfig config.UserConfig) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.config.MergeUserConfig(userconfig)
+}
+
+//Store return the store, nil when the database is not open
+func (handler *Handler) Store() Store {
+	return handler.db.Store()
+}
+
+//SetStore replace the store and return the previous one, which is not closed
+func (handler *Handler) SetStore(store Store) Store {
+	return handler.db.Set(store)
+}
+
+//DatabaseReady return the channel closed when the database is open
+func (handler *Handler) DatabaseReady() <-chan struct{} {
+	return handler.db.Ready()
+}
+
+//isLocalConnected check whether the local MQTT broker is connected
+func (handler *Handler) isLocalConnected() bool {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.localConnected
+}
+
+//setLocalConnected set the connected flag of the local MQTT broker
+func (handler *Handler) setLocalConnected(connected bool) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.localConnected = connected
+}
+
+//commandTopic return the topic for remote commands, which is changed by restart
+func (handler *Handler) commandTopic() string {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.CommandTopic
+}
+
+//applyTopics set the topics of the handler and every remote from the config with "+" replaced by the client ID
+func (handler *Handler) applyTopics() {
+	conf := handler.conf()
+	clientID := conf.Mqtt.ClientID
+	handler.lock.Lock()
+	handler.RawTopic = strings.Replace(conf.Mqtt.RawTopic, "+", clientID, 1)
+	handler.PollutantTopic = strings.Replace(conf.Mqtt.PollutantTopic, "+", clientID, 1)
+	handler.ResendRawTopic = strings.Replace(conf.Mqtt.ResendRawTopic, "+", clientID, 1)
+	handler.ResendPollutantTopic = strings.Replace(conf.Mqtt.ResendPollutantTopic, "+", clientID, 1)
+	handler.CommandTopic = strings.Replace(conf.Mqtt.CommandTopic, "+", clientID, 1)
+	handler.lock.Unlock()
+	for _, remoteConfig := range conf.Remotes() {
+		for _, remote := range handler.Remotes {
+			if remote.Name == remoteConfig.Name {
+				remote.setTopics(remoteConfig, clientID)
+			}
+		}
+	}
+}
+
+//openDB open the database in background unless it is open or another goroutine is opening it
+func (handler *Handler) openDB() {
+	if handler.db.startOpening() {
+		go handler.initDB()
+	}
+}
+
+//initDB initialize the default SQLite store after the clock is synchronized, retrying until it is open or
+//the service is shutting down. It should only be run by openDB
+func (handler *Handler) initDB() {
+	var date time.Time
 	for {
 		//Checking whether the time is synchonized or not
 		date = time.Now().UTC()
-		if date.Before(mileStoneTime) {
-			time.Sleep(15 * time.Second)
-			continue
+		if clockSynchronized(date) {
+			break
+		}
+		if !handler.sleep(15 * time.Second) {
+			handler.db.stopOpening()
+			return
 		}
-		break
 	}
-	//Get the path to create or open the database file
-	dbPath := fmt.Sprintf(
-		"%v/%v_%v.db?cache=shared&mode=rwc&_journal_mode=WAL",
-		handler.config.Server.MainFolder,
-		handler.config.Mqtt.ClientID,
-		date.Format("200601"),
-	)
 	//Try to open connection to the database
 	for {
-		db, err = sql.Open("sqlite3", dbPath)
-		if err != nil {
-			handler.MainLogger.Errorf("Unable to open database for storing data:%v", err)
-			handler.isReadOnlyError(err)
-			time.Sleep(time.Second * 30)
-			continue
+		store, err := handler.openStore(date)
+		if err == nil {
+			handler.storeOpened(store)
+			return
+		}
+		handler.MainLogger.Errorf("Unable to open database for storing data:%v", err)
+		handler.checkStorageError(err)
+		if !handler.sleep(30 * time.Second) {
+			handler.db.stopOpening()
+			return
 		}
-		break
-	}
-	handler.DB = db
-	sqlStmt := `
-	create table if not exists pollutant (id integer not null primary key, ts timestamp,data json,sent bool default false);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		handler.MainLogger.Errorf("Unable to create pollutant table:%v", err)
 	}
-	sqlStmt = `
-	create table if not exists raw (id integer not null primary key, ts timestamp,data json,sent bool default false);
-	`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		handler.MainLogger.Errorf("Unable to create raw table:%v", err)
+}
+
+//storeOpened set the store opened and flush the samples buffered until then. The store is closed when another
+//one is already open
+func (handler *Handler) storeOpened(store Store) {
+	if !handler.db.opened(store) {
+		if err := store.Close(); err != nil {
+			handler.MainLogger.Errorf("Unable to close connection with database:%v", err)
+		}
+		return
 	}
+	handler.flushBuffer(store)
 }
 
-//startTx start a transaction with DB
-func (handler *Handler) startTx() (*sql.Tx, error) {
-	if handler.DB == nil {
-		go handler.InitDB()
-		return nil, fmt.Errorf("Database not connected")
+//flushBuffer save the samples buffered in memory into the store, oldest first, until the buffer is empty or
+//an insert fails. The sample failed to be saved is put back as the oldest one, so the buffer stays in order
+func (handler *Handler) flushBuffer(store Store) {
+	handler.db.flushing.Lock()
+	defer handler.db.flushing.Unlock()
+	saved := 0
+	for {
+		sample, ok := handler.db.pop()
+		if !ok {
+			break
+		}
+		if err := handler.insert(store, sample); err != nil {
+			handler.MainLogger.Errorf("Error when save buffered %v to database:%v", sample.name(), err)
+			if err = handler.drop(handler.db.requeue(sample)); err != nil {
+				handler.MainLogger.Error(err)
+			}
+			break
+		}
+		saved++
 	}
-	tx, err := handler.DB.Begin()
-	if err != nil {
-		return nil, fmt.Errorf("Unable to setup connection to database")
+	if saved > 0 {
+		handler.MainLogger.Infof("Saved %v samples buffered in memory into database", saved)
 	}
-	return tx, nil
 }
 
-//fixFileSystem will try to fix the file system for SD card when read-only file system problem
-//happens on the SD card
-func (handler *Handler) fixFileSystem() {
-	if _, err := exec.Command("fsck.fat", "-a", "/dev/mmcblk0p1").Output(); err != nil {
-		log.Printf("File System repair Fail:%v\n", err)
+//sleep wait for the duration and return true, or return false when the service is shutting down
+func (handler *Handler) sleep(duration time.Duration) bool {
+	select {
+	case <-handler.done:
+		return false
+	case <-time.After(duration):
+		return true
 	}
 }
 
-//isReadOnlyError will detect whether the error is a read-only file system error or not
-func (handler *Handler) isReadOnlyError(err error) {
-	if errString := fmt.Sprintf("%v", err); strings.Contains(errString, "read-only file system") {
-		log.Println("We got read-only file system error, will try to fix the file system for Onion")
-		handler.fixFileSystem()
+//background run the job in its own goroutine, e.g. a resend which would block the callback of a transport.
+//Run waits for the jobs before closing the store, and no job is started after that. It returns false when
+//the job is not started
+func (handler *Handler) background(job func()) bool {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	if handler.stopping {
+		handler.MainLogger.Warn("Service is shutting down, job not started")
+		return false
+	}
+	handler.jobs.Add(1)
+	go func() {
+		defer handler.jobs.Done()
+		job()
+	}()
+	return true
+}
+
+//waitJobs stop starting jobs in background and wait for the running ones, which end early once done is closed
+func (handler *Handler) waitJobs() {
+	handler.lock.Lock()
+	handler.stopping = true
+	handler.lock.Unlock()
+	handler.jobs.Wait()
+}
+
+//openStore open the default SQLite store with the database file of the month of date
+func (handler *Handler) openStore(date time.Time) (Store, error) {
+	conf := handler.conf()
+	store, err := NewSQLiteStore(
+		conf.Server.MainFolder,
+		conf.Mqtt.ClientID,
+		conf.RemoteNames(),
+		handler.MainLogger,
+		date,
+	)
+	if err != nil {
+		return nil, err
 	}
+	return store, nil
 }
 
 //onConnectionHandlerLo will subscribe to pollutant/raw topic with local MQTT broker
 //It will also subscribe to resend pollutant/raw topic with local MQTT broker (For local UI to send resend request)
-func (handler *Handler) onConnectionHandlerLo(c mqtt.Client) {
+func (handler *Handler) onConnectionHandlerLo(transport Transport) {
 	handler.MainLogger.Info("MQTT client get connection with local MQTT broker")
-	var token mqtt.Token
-	token = handler.LocalMqttClient.Subscribe(handler.PollutantTopic, 0, handler.pollutantHandler)
-	handler.subTokenHandler(token, handler.PollutantTopic)
-
-	token = handler.LocalMqttClient.Subscribe(handler.RawTopic, 0, handler.rawHandler)
-	handler.subTokenHandler(token, handler.RawTopic)
-
-	token = handler.LocalMqttClient.Subscribe(handler.ResendPollutantTopic, 0, handler.resendPollutantHandler)
-	handler.subTokenHandler(token, handler.ResendPollutantTopic)
-
-	token = handler.LocalMqttClient.Subscribe(handler.ResendRawTopic, 0, handler.resendRawHandler)
-	handler.subTokenHandler(token, handler.ResendRawTopic)
+	handler.setLocalConnected(true)
+	handler.lock.RLock()
+	pollutantTopic, rawTopic := handler.PollutantTopic, handler.RawTopic
+	resendPollutantTopic, resendRawTopic := handler.ResendPollutantTopic, handler.ResendRawTopic
+	handler.lock.RUnlock()
+	handler.subscribe(transport, pollutantTopic, handler.pollutantHandler)
+	handler.subscribe(transport, rawTopic, handler.rawHandler)
+	handler.subscribe(transport, resendPollutantTopic, handler.resendPollutantHandler)
+	handler.subscribe(transport, resendRawTopic, handler.resendRawHandler)
 }
 
-//ontConnectionHandler will subscribe to resend pollutant/raw topic with remote MQTT broker
-//It will also set the remoteMqttConnected flag to true
-func (handler *Handler) ontConnectionHandler(c mqtt.Client) {
-	handler.MainLogger.Info("MQTT client get connection with remote MQTT broker")
-	handler.remoteMqttConnected = true
-	var token mqtt.Token
-	token = handler.RemoteMqttClient.Subscribe(handler.ResendRawTopic, 0, handler.resendRawHandler)
-	handler.subTokenHandler(token, handler.ResendRawTopic)
-
-	token = handler.RemoteMqttClient.Subscribe(handler.ResendPollutantTopic, 0, handler.resendPollutantHandler)
-	handler.subTokenHandler(token, handler.ResendPollutantTopic)
+//ontConnectionHandler will subscribe to resend pollutant/raw topic and command topic with the remote MQTT broker
+//It will also set the connected flag of the remote to true and wake up its outboxes to drain unsent data
+func (handler *Handler) ontConnectionHandler(remote *Remote, transport Transport) {
+	handler.MainLogger.Infof("MQTT client get connection with remote MQTT broker %v", remote.Name)
+	remote.setConnected(true)
+	handler.publishOnline(remote)
+	remote.lock.RLock()
+	resendRawTopic, resendPollutantTopic := remote.ResendRawTopic, remote.ResendPollutantTopic
+	remote.lock.RUnlock()
+	handler.subscribe(transport, resendRawTopic, handler.resendRawHandler)
+	handler.subscribe(transport, resendPollutantTopic, handler.resendPollutantHandler)
+	if commandTopic := handler.commandTopic(); commandTopic != "" {
+		handler.subscribe(transport, commandTopic, handler.commandHandler)
+	}
+	remote.rawOutbox.Wake()
+	remote.pollutantOutbox.Wake()
 }
 
-func (handler *Handler) lostConnectionHandlerLo(c mqtt.Client, err error) {
+func (handler *Handler) lostConnectionHandlerLo(transport Transport, err error) {
 	handler.MainLogger.Errorf("MQTT client lost connection with local MQTT broker:%v", err)
+	handler.setLocalConnected(false)
 }
 
-//lostConnectionHandler will set remoteMqttConnected flag to false
-func (handler *Handler) lostConnectionHandler(c mqtt.Client, err error) {
-	handler.MainLogger.Errorf("MQTT client lost connection with remote MQTT broker:%v", err)
-	handler.remoteMqttConnected = false
-	token := handler.RemoteMqttClient.Connect()
-	for !token.WaitTimeout(5 * time.Second) {
-	}
-	if token.Error() != nil {
-		err := token.Error()
-		handler.MainLogger.Errorf("Error when client connect to remote MQTT broker:%v", err)
+//lostConnectionHandler will set the connected flag of the remote to false and try to reconnect
+func (handler *Handler) lostConnectionHandler(remote *Remote, transport Transport, err error) {
+	handler.MainLogger.Errorf("MQTT client lost connection with remote MQTT broker %v:%v", remote.Name, err)
+	remote.setConnected(false)
+	if err = transport.Connect(); err != nil {
+		handler.MainLogger.Errorf("Error when client connect to remote MQTT broker %v:%v", remote.Name, err)
 	}
 }
 
 //rawHandler is the handler for local MQTT client when it receive raw data from local MQTT broker.
-//It will try to send data to remote MQTT broker and save data to local database
-func (handler *Handler) rawHandler(client mqtt.Client, msg mqtt.Message) {
-	var sendSuccessful bool = false
-	if handler.config.Server.SendRawData {
-		if err := handler.sendRaw(msg.Payload()); err != nil {
-			handler.MainLogger.Errorf("Error when send raw data to remote server:%v", err)
-		} else {
-			sendSuccessful = true
-		}
-	}
-	if handler.config.Server.LogRaw {
-		if err := handler.saveRawDatabase(msg.Payload(), sendSuccessful); err != nil {
+//It will try to send data to every remote MQTT broker and save data to local database. Invalid data is
+//quarantined into the dead letters instead, unless raw data is neither sent nor saved
+func (handler *Handler) rawHandler(transport Transport, msg Message) {
+	handler.Metrics.Received(RawTable)
+	conf := handler.conf()
+	if !conf.Server.SendRawData && !conf.Server.LogRaw {
+		return
+	}
+	timestamp, err := validateSample(RawTable, msg.Payload(), conf.Mqtt.ClientID, time.Now())
+	if err != nil {
+		handler.quarantine(RawTable, msg, err)
+		return
+	}
+	var delivered []string
+	if conf.Server.SendRawData {
+		delivered = handler.forward(RawTable, msg.Payload())
+	}
+	if conf.Server.LogRaw {
+		if err := handler.saveDatabase(RawTable, timestamp, msg.Payload(), delivered); err != nil {
 			handler.MainLogger.Errorf("Error when save raw data to database:%v", err)
 		}
 	}
 }
 
 //pollutantHandler is the handler for local MQTT client when it receive pollutant data from local MQTT broker.
-//It will try to send data to remote MQTT broker and save data to local database
-func (handler *Handler) pollutantHandler(client mqtt.Client, msg mqtt.Message) {
-	var sendSuccessful bool = false
-	if handler.config.Server.SendPollutantData {
-		if err := handler.sendPollutant(msg.Payload()); err != nil {
-			handler.MainLogger.Errorf("Error when send pollutant data to remote server:%v", err)
-		} else {
-			sendSuccessful = true
-		}
-	}
-	if handler.config.Server.LogPollutant {
-		if err := handler.savePollutantDatabase(msg.Payload(), sendSuccessful); err != nil {
+//It will try to send data to every remote MQTT broker and save data to local database. Invalid data is
+//quarantined into the dead letters instead, unless pollutant data is neither sent nor saved
+func (handler *Handler) pollutantHandler(transport Transport, msg Message) {
+	handler.Metrics.Received(PollutantTable)
+	conf := handler.conf()
+	if !conf.Server.SendPollutantData && !conf.Server.LogPollutant {
+		return
+	}
+	timestamp, err := validateSample(PollutantTable, msg.Payload(), conf.Mqtt.ClientID, time.Now())
+	if err != nil {
+		handler.quarantine(PollutantTable, msg, err)
+		return
+	}
+	var delivered []string
+	if conf.Server.SendPollutantData {
+		delivered = handler.forward(PollutantTable, msg.Payload())
+	}
+	if conf.Server.LogPollutant {
+		if err := handler.saveDatabase(PollutantTable, timestamp, msg.Payload(), delivered); err != nil {
 			handler.MainLogger.Errorf("Error when save pollutant data to database:%v", err)
 		}
 	}
 }
 
-/*
-TODO: Currently, resend handler cannot handler the situation when the month change.
-For example, if you are now in April 2021, you cannot request the this software to resend data before April 1st, 2021,
-even if the database file is there. The resend logic should be update to handler this kind of request.
-*/
+//forward send data of the table to every remote and return the names of the remotes which received it
+func (handler *Handler) forward(table string, data []byte) []string {
+	var delivered []string
+	for _, remote := range handler.Remotes {
+		err := remote.send(table, data)
+		handler.Metrics.Forwarded(remote.Name, table, err)
+		if err != nil {
+			handler.MainLogger.Errorf("Error when send %v data to remote server %v:%v", table, remote.Name, err)
+			continue
+		}
+		delivered = append(delivered, remote.Name)
+	}
+	return delivered
+}
 
 /*resendRawHandler is the handler for resend request for raw data.
-The request format should be (in json)
+A request from a remote MQTT broker resends to that remote, a request from local MQTT broker resends to
+every remote, or only to the remote named by Destination. The ResendResponse is published on the broker
+which the request arrived on. The request format should be (in json)
 
 {
+	"requestId":(Optional request ID in string, echoed in the response),
 	"StartDate":(Unix time in int64),
-	"EndDate":(Unix time in int64)
+	"EndDate":(Unix time in int64),
+	"Destination":(Optional remote name in string),
+	"IncludeSent":(Optional bool, replay rows already sent as well),
+	"Limit":(Optional maximum number of rows in int),
+	"Order":(Optional "asc" or "desc"),
+	"Topic":(Optional topic override in string),
+	"Rate":(Optional maximum rows per second in float),
+	"Keys":(Optional pollutant or raw keys in string array),
+	"DryRun":(Optional bool, only count the rows)
 }
 */
-func (handler *Handler) resendRawHandler(client mqtt.Client, msg mqtt.Message) {
-	handler.MainLogger.Info("Get resend raw data request")
-	resTopic := fmt.Sprintf("%v/response", msg.Topic())
-	var resStr string
-	var err error
-	var request ResendRequest
-	if err = json.Unmarshal(msg.Payload(), &request); err != nil {
-		resStr = fmt.Sprintf("Unable to parse resend request:%v", err)
-		handler.MainLogger.Errorf(resStr)
-		handler.mqttResponse(resTopic, resStr, false)
-		return
-	}
-	if err = handler.resendRaw(request.StartDate, request.EndDate); err != nil {
-		resStr = fmt.Sprintf("Fail to resend:%v", err)
-		handler.MainLogger.Errorf(resStr)
-		handler.mqttResponse(resTopic, resStr, false)
-	} else {
-		startdate := time.Unix(request.StartDate, 0)
-		enddate := time.Unix(request.EndDate, 0)
-		resStr = fmt.Sprintf(
-			"Successfully resend raw data between %v and %v",
-			startdate.Format(time.RFC3339),
-			enddate.Format(time.RFC3339),
-		)
-		handler.mqttResponse(resTopic, resStr, true)
-	}
+func (handler *Handler) resendRawHandler(transport Transport, msg Message) {
+	handler.resendHandler(transport, msg, RawTable)
 }
 
 /*resendPollutantHandler is the handler for resend request for pollutant data.
-The request format should be (in json)
+A request from a remote MQTT broker resends to that remote, a request from local MQTT broker resends to
+every remote, or only to the remote named by Destination. The ResendResponse is published on the broker
+which the request arrived on. The request format should be (in json)
 
 {
+	"requestId":(Optional request ID in string, echoed in the response),
 	"StartDate":(Unix time in int64),
-	"EndDate":(Unix time in int64)
+	"EndDate":(Unix time in int64),
+	"Destination":(Optional remote name in string),
+	"IncludeSent":(Optional bool, replay rows already sent as well),
+	"Limit":(Optional maximum number of rows in int),
+	"Order":(Optional "asc" or "desc"),
+	"Topic":(Optional topic override in string),
+	"Rate":(Optional maximum rows per second in float),
+	"Keys":(Optional pollutant or raw keys in string array),
+	"DryRun":(Optional bool, only count the rows)
 }
 */
-func (handler *Handler) resendPollutantHandler(client mqtt.Client, msg mqtt.Message) {
-	handler.MainLogger.Info("Get resend pollutant data request")
-	resTopic := fmt.Sprintf("%v/response", msg.Topic())
-	var resStr string
-	var err error
+func (handler *Handler) resendPollutantHandler(transport Transport, msg Message) {
+	handler.resendHandler(transport, msg, PollutantTable)
+}
+
+//resendHandler handle the resend request of the table and publish the response on the transport it arrived on.
+//Invalid requests are responded at once. The resend runs in background, since it may wait long for the rate limits
+//and the transport delivers the messages of a client in order, so live samples would be stalled behind the backlog
+func (handler *Handler) resendHandler(transport Transport, msg Message, table string) {
+	handler.MainLogger.Infof("Get resend %v data request", table)
+	topic := fmt.Sprintf("%v/response", msg.Topic())
+	response := ResendResponse{Version: ResendResponseVersion, Table: table}
 	var request ResendRequest
-	if err = json.Unmarshal(msg.Payload(), &request); err != nil {
-		resStr := fmt.Sprintf("Unable to parse resend request:%v", err)
-		handler.MainLogger.Errorf(resStr)
-		handler.mqttResponse(resTopic, resStr, false)
+	if err := json.Unmarshal(msg.Payload(), &request); err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = fmt.Sprintf("Unable to parse resend request:%v", err)
+		handler.respondResend(transport, topic, response)
 		return
 	}
-	if err = handler.resendPollutant(request.StartDate, request.EndDate); err != nil {
-		resStr = fmt.Sprintf("Fail to resend:%v", err)
-		handler.MainLogger.Errorf(resStr)
-		handler.mqttResponse(resTopic, resStr, false)
-	} else {
-		startdate := time.Unix(request.StartDate, 0)
-		enddate := time.Unix(request.EndDate, 0)
-		resStr = fmt.Sprintf(
-			"Successfully resend pollutant data between %v and %v",
-			startdate.Format(time.RFC3339),
-			enddate.Format(time.RFC3339),
-		)
-		handler.mqttResponse(resTopic, resStr, true)
+	response.RequestID = request.RequestID
+	response.StartDate = request.StartDate
+	response.EndDate = request.EndDate
+	remotes, err := handler.resendRequestTargets(transport, request)
+	if err != nil {
+		response.Code = http.StatusBadRequest
+		response.Message = err.Error()
+		handler.respondResend(transport, topic, response)
+		return
 	}
+	handler.background(func() {
+		handler.resend(remotes, table, request, &response)
+		handler.respondResend(transport, topic, response)
+	})
 }
 
-func (handler *Handler) resendRaw(startdate int64, enddate int64) (err error) {
-	handler.MainLogger.Info("Resending raw data triggered.")
-	if !handler.remoteMqttConnected {
-		return fmt.Errorf("Remote MQTT client not connected")
+//respondResend log the response when the resend failed and publish it to the topic with the transport
+func (handler *Handler) respondResend(transport Transport, topic string, response ResendResponse) {
+	if !response.Success {
+		handler.MainLogger.Errorf("%v (request %v)", response.Message, response.RequestID)
 	}
-	if handler.DB == nil {
-		go handler.InitDB()
-		return fmt.Errorf("Database not connected")
+	handler.mqttResponse(transport, topic, response)
+}
+
+//resendRequestTargets validate the resend request arrived on the transport and return the remotes to resend to
+func (handler *Handler) resendRequestTargets(transport Transport, request ResendRequest) ([]*Remote, error) {
+	if err := request.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid resend request:%v", err)
 	}
-	selectStmt := `
-	select id,ts,data from raw where sent = false and ts between ? and ?
-	`
-	updateStmt := `
-	update raw set sent = true where id = ?
-	`
-	tx, err := handler.startTx()
+	remotes, err := handler.resendTargets(transport, request.Destination)
 	if err != nil {
-		return fmt.Errorf("Error when start transaction for resend raw:%v", err)
+		return nil, fmt.Errorf("Fail to resend:%v", err)
 	}
-	stmt, err := tx.Prepare(updateStmt)
+	return remotes, nil
+}
+
+//resend resend the table to the remotes for the request and fill in the response with the result
+func (handler *Handler) resend(remotes []*Remote, table string, request ResendRequest, response *ResendResponse) {
+	handler.MainLogger.Infof("Resending %v data triggered.", table)
+	result, err := handler.resendRemotes(remotes, table, request)
+	response.Matched = result.Matched
+	response.Attempted = result.Attempted
+	response.Succeeded = result.Succeeded
+	response.Failed = result.Failed
+	response.Remaining = result.Remaining
+	response.Files = result.Files
 	if err != nil {
-		return fmt.Errorf("Error when start transaction for resend raw:%v", err)
+		response.Code = http.StatusServiceUnavailable
+		if result.Failed > 0 {
+			response.Code = http.StatusBadGateway
+		}
+		response.Message = fmt.Sprintf("Fail to resend:%v", err)
+		return
 	}
-	defer stmt.Close()
-	rows, err := handler.DB.Query(selectStmt, startdate, enddate)
-	if err != nil {
-		return fmt.Errorf("Error when query data for resend raw:%v", err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var id int
-		var ts time.Time
-		var jsonBinary []byte
-		err = rows.Scan(&id, &ts, &jsonBinary)
-		if err != nil {
-			return fmt.Errorf("Unable to fetch raw data from database:%v", err)
+	response.Success = true
+	response.Code = http.StatusOK
+	if request.DryRun {
+		response.Message = fmt.Sprintf("%v %v rows would be resent", result.Matched, table)
+		return
+	}
+	response.Message = fmt.Sprintf(
+		"Successfully resend %v data between %v and %v",
+		table,
+		time.Unix(request.StartDate, 0).Format(time.RFC3339),
+		time.Unix(request.EndDate, 0).Format(time.RFC3339),
+	)
+}
+
+//validate check the time range and options of the resend request
+func (request ResendRequest) validate() error {
+	if request.StartDate > request.EndDate {
+		return fmt.Errorf("StartDate should not be after EndDate")
+	}
+	if request.Limit < 0 || request.Rate < 0 {
+		return fmt.Errorf("Limit and Rate should not be negative")
+	}
+	if request.Order != "" && request.Order != OrderAsc && request.Order != OrderDesc {
+		return fmt.Errorf("Order should be %v or %v", OrderAsc, OrderDesc)
+	}
+	return nil
+}
+
+//remote return the remote destination which uses the transport, nil for local MQTT broker
+func (handler *Handler) remote(transport Transport) *Remote {
+	for _, remote := range handler.Remotes {
+		if remote.Transport == transport {
+			return remote
+		}
+	}
+	return nil
+}
+
+//resendTargets return the remotes to resend to for a request arrived on the transport
+func (handler *Handler) resendTargets(transport Transport, destination string) ([]*Remote, error) {
+	if remote := handler.remote(transport); remote != nil {
+		if destination != "" && destination != remote.Name {
+			return nil, fmt.Errorf("Remote %v is not allowed to resend to %v", remote.Name, destination)
 		}
-		err = handler.sendRaw(jsonBinary)
+		return []*Remote{remote}, nil
+	}
+	if destination == "" {
+		return handler.Remotes, nil
+	}
+	for _, remote := range handler.Remotes {
+		if remote.Name == destination {
+			return []*Remote{remote}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown destination %v", destination)
+}
+
+//resendRemotes resend unsent data of the table to each remote in turn and sum up the results.
+//A failure of one remote does not stop resending to the others
+func (handler *Handler) resendRemotes(remotes []*Remote, table string, request ResendRequest) (ResendResult, error) {
+	var total ResendResult
+	var errs []string
+	for _, remote := range remotes {
+		result, err := handler.resendTable(remote, table, request)
 		if err != nil {
-			return fmt.Errorf("Error when update database for resend raw:%v", err)
-		} else {
-			_, err = stmt.Exec(id)
-			if err != nil {
-				return fmt.Errorf("Error when update database for resend raw:%v", err)
-			}
+			errs = append(errs, fmt.Sprintf("%v:%v", remote.Name, err))
 		}
+		total.Matched += result.Matched
+		total.Attempted += result.Attempted
+		total.Succeeded += result.Succeeded
+		total.Failed += result.Failed
+		total.Remaining += result.Remaining
+		total.Files = append(total.Files, result.Files...)
 	}
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("Error when commit database for resend raw:%v", err)
+	if len(errs) > 0 {
+		return total, fmt.Errorf("%v", strings.Join(errs, ", "))
 	}
-	return nil
+	return total, nil
 }
 
-func (handler *Handler) resendPollutant(startdate int64, enddate int64) (err error) {
-	handler.MainLogger.Info("Resending pollutant data triggered.")
-	if !handler.remoteMqttConnected {
-		return fmt.Errorf("Remote MQTT client not connected")
+//resendTable resend data of the table selected by the request to the remote from every partition of the store
+//covering the time range, read page by page in the order of the request. By default only rows not delivered to the
+//remote are selected, oldest first. Rows are sent in batches of ResendBatchSize and every batch is committed once sent,
+//so rows already delivered are marked as sent even if a later publish fails. Rows sent to an overridden topic are
+//not marked. The resend stops at the first failed publish. Only one resend of the table to the remote runs at a
+//time, others are queued and only select the rows still unsent when they start, so no row is sent twice
+func (handler *Handler) resendTable(remote *Remote, table string, request ResendRequest) (ResendResult, error) {
+	var result ResendResult
+	if !request.DryRun {
+		lock := remote.resendLock(table)
+		lock.Lock()
+		defer lock.Unlock()
+		if !remote.isConnected() {
+			return result, fmt.Errorf("Remote MQTT client not connected")
+		}
 	}
-	if handler.DB == nil {
-		go handler.InitDB()
-		return fmt.Errorf("Database not connected")
+	store := handler.Store()
+	if store == nil {
+		handler.openDB()
+		return result, fmt.Errorf("Database not connected")
 	}
-	selectStmt := `
-	select id,ts,data from pollutant where sent = false and ts between ? and ?
-	`
-	updateStmt := `
-	update pollutant set sent = true where id = ?
-	`
-	tx, err := handler.startTx()
-	if err != nil {
-		return fmt.Errorf("Error when start transaction for resend pollutant:%v", err)
+	conf := handler.conf()
+	batchSize := conf.Mqtt.ResendBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultResendBatchSize
 	}
-	stmt, err := tx.Prepare(updateStmt)
-	if err != nil {
-		return fmt.Errorf("Error when start transaction for resend pollutant:%v", err)
+	filter := Filter{
+		Table:      table,
+		StartDate:  request.StartDate,
+		EndDate:    request.EndDate,
+		Descending: request.Order == OrderDesc,
+		Limit:      batchSize,
+		Keys:       request.Keys,
 	}
-	defer stmt.Close()
-	rows, err := handler.DB.Query(selectStmt, startdate, enddate)
-	if err != nil {
-		return fmt.Errorf("Error when query data for resend pollutant:%v", err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var id int
-		var ts time.Time
-		var jsonBinary []byte
-		err = rows.Scan(&id, &ts, &jsonBinary)
+	if !request.IncludeSent {
+		filter.Unsent = remote.Name
+	}
+	topic := remote.topic(table)
+	if request.Topic != "" {
+		topic = strings.Replace(request.Topic, "+", conf.Mqtt.ClientID, 1)
+	}
+	var sendErr error
+	for sendErr == nil {
+		records, err := store.Find(filter)
 		if err != nil {
-			return fmt.Errorf("Unable to fetch pollutant data from database:%v", err)
+			handler.checkStorageError(err)
+			return result, fmt.Errorf("Error when query data for resend %v:%v", table, err)
 		}
-		err = handler.sendPollutant(jsonBinary)
-		if err != nil {
-			return fmt.Errorf("Error when update database for resend pollutant:%v", err)
-		} else {
-			_, err = stmt.Exec(id)
-			if err != nil {
-				return fmt.Errorf("Error when update database for resend pollutant:%v", err)
-			}
+		if len(records) == 0 {
+			break
+		}
+		last := len(records) < batchSize
+		after := records[len(records)-1]
+		filter.After = &after
+		if request.Limit > 0 && result.Matched+len(records) >= request.Limit {
+			records = records[:request.Limit-result.Matched]
+			last = true
+		}
+		result.Matched += len(records)
+		if !request.DryRun {
+			sendErr = handler.sendPage(store, remote, table, topic, request, records, &result)
+		}
+		if last {
+			break
 		}
 	}
-	err = tx.Commit()
+	remaining, err := store.CountUnsent(remote.Name, table, request.StartDate, request.EndDate)
 	if err != nil {
-		return fmt.Errorf("Error when commit database for resend pollutant:%v", err)
+		handler.MainLogger.Errorf("Error when count remaining %v:%v", table, err)
 	}
-	return nil
+	result.Remaining = remaining
+	if sendErr != nil {
+		return result, fmt.Errorf("Error when resend %v:%v", table, sendErr)
+	}
+	return result, nil
 }
 
-func (handler *Handler) saveRawDatabase(data []byte, sendSuccessful bool) error {
-	var err error
-	tx, err := handler.startTx()
-	if err != nil {
-		return err
+//sendPage send one page of records to the topic of the remote in batches, throttled by the resend limiter of the
+//remote and the rate of the request, and mark the rows sent so far in the store. It returns the error of the failed publish
+func (handler *Handler) sendPage(
+	store Store,
+	remote *Remote,
+	table string,
+	topic string,
+	request ResendRequest,
+	records []Record,
+	result *ResendResult,
+) error {
+	var sendErr error
+	sent := 0
+	for sent < len(records) {
+		batch := remote.batch(records[sent:])
+		size := 0
+		for _, record := range batch {
+			size += len(record.Data)
+		}
+		if !remote.limiter.Wait(handler.done, len(batch), size) {
+			sendErr = fmt.Errorf("Service is shutting down")
+			break
+		}
+		result.Attempted += len(batch)
+		sendErr = remote.sendRecords(topic, batch)
+		handler.Metrics.Resent(remote.Name, table, len(batch), sendErr)
+		if sendErr != nil {
+			result.Failed += len(batch)
+			result.failedAt = batch[0].Timestamp
+			break
+		}
+		sent += len(batch)
+		handler.throttle(request.Rate, len(batch))
 	}
-	sqlStmt := `
-	insert into raw(ts,data,sent) values (?,?,?)
-	`
-	stmt, err := tx.Prepare(sqlStmt)
-	if err != nil {
-		return err
+	if sent == 0 {
+		return sendErr
 	}
-	defer stmt.Close()
-	var rawDataMsgPack RawDataMsgPack
-	err = msgpack.Unmarshal(data, &rawDataMsgPack)
-	if err != nil {
-		return err
+	if request.Topic == "" {
+		if err := store.MarkSent(remote.Name, table, records[:sent]); err != nil {
+			handler.checkStorageError(err)
+			return fmt.Errorf("Error when update database for resend %v:%v", table, err)
+		}
 	}
-	_, err = stmt.Exec(rawDataMsgPack.Timestamp, data, sendSuccessful)
-	if err != nil {
-		return err
+	result.Succeeded += sent
+	result.addFiles(records[:sent])
+	return sendErr
+}
+
+//throttle wait for the time to send the rows at the rate (rows per second), or until the service is shutting down
+func (handler *Handler) throttle(rate float64, rows int) {
+	if rate <= 0 {
+		return
 	}
-	err = tx.Commit()
-	if err != nil {
-		return err
+	select {
+	case <-handler.done:
+	case <-time.After(time.Duration(float64(rows) / rate * float64(time.Second))):
 	}
-	return nil
 }
 
-func (handler *Handler) savePollutantDatabase(data []byte, sendSuccessful bool) error {
-	var err error
-	tx, err := handler.startTx()
-	if err != nil {
-		return err
+//addFiles count the resent records for each partition
+func (result *ResendResult) addFiles(records []Record) {
+	for _, record := range records {
+		last := len(result.Files) - 1
+		if last >= 0 && result.Files[last].File == record.Partition {
+			result.Files[last].Resent++
+			continue
+		}
+		result.Files = append(result.Files, ResendFileResult{File: record.Partition, Resent: 1})
 	}
-	sqlStmt := `
-	insert into pollutant(ts,data,sent) values (?,?,?)
-	`
-	stmt, err := tx.Prepare(sqlStmt)
-	if err != nil {
-		return err
+}
+
+//saveDatabase insert the sample into the table of the store. When the database is not ready yet or fails to
+//insert, e.g. the SD card is read-only, the sample is buffered in memory. The buffer is flushed once the
+//database is open, or after the next sample is saved. It returns the error when a sample is dropped from the buffer
+func (handler *Handler) saveDatabase(table string, timestamp int64, data []byte, delivered []string) error {
+	return handler.save(pendingSample{table: table, timestamp: timestamp, data: data, delivered: delivered})
+}
+
+//save insert the sample, or the dead letter, into the store, or buffer it in memory like saveDatabase.
+//The store is not replaced by Database.Set until the sample is saved
+func (handler *Handler) save(sample pendingSample) error {
+	handler.db.saving.RLock()
+	defer handler.db.saving.RUnlock()
+	store, dropped := handler.db.storeOrBuffer(sample)
+	if store == nil {
+		handler.openDB()
+		return handler.drop(dropped)
 	}
-	defer stmt.Close()
-	var pollutantDataMsgPack PollutantDataMsgPack
-	err = msgpack.Unmarshal(data, &pollutantDataMsgPack)
-	if err != nil {
-		return err
+	if err := handler.insert(store, sample); err != nil {
+		handler.MainLogger.Errorf("Error when save %v to database, buffered in memory:%v", sample.name(), err)
+		return handler.drop(handler.db.bufferSample(sample))
 	}
-	_, err = stmt.Exec(pollutantDataMsgPack.Timestamp, data, sendSuccessful)
-	if err != nil {
+	if handler.db.Buffered() > 0 {
+		handler.flushBuffer(store)
+	}
+	return nil
+}
+
+//drop count the sample dropped from the buffer as failed to be saved and return the error, nil when no sample is dropped.
+//A dead letter dropped is only counted as dropped from the buffer
+func (handler *Handler) drop(sample *pendingSample) error {
+	if sample == nil {
+		return nil
+	}
+	err := fmt.Errorf(
+		"Buffer is full, %v of %v dropped",
+		sample.name(),
+		time.Unix(sample.timestamp, 0).UTC().Format(time.RFC3339),
+	)
+	if sample.letter == nil {
+		handler.Metrics.Saved(sample.table, err)
+	}
+	return err
+}
+
+//insert insert the sample into the store, or the dead letter into the dead letters of the store. The sample is notified
+//to the outbox of every remote which did not receive it
+func (handler *Handler) insert(store Store, sample pendingSample) error {
+	if sample.letter != nil {
+		err := store.Quarantine(*sample.letter)
+		handler.checkStorageError(err)
 		return err
 	}
-	err = tx.Commit()
+	err := store.Insert(sample.table, sample.timestamp, sample.data, sample.delivered)
 	if err != nil {
+		handler.checkStorageError(err)
 		return err
 	}
+	handler.Metrics.Saved(sample.table, nil)
+	handler.notify(sample)
 	return nil
 }
 
-//sendRaw sending raw data to remote MQTT broker
-func (handler *Handler) sendRaw(data []byte) error {
-	token := handler.RemoteMqttClient.Publish(handler.RawTopic, handler.config.Mqtt.Qos, false, data)
-	return handler.pubTokenHandler(token)
+//notify notify the sample saved to the outbox of every remote which did not receive it
+func (handler *Handler) notify(sample pendingSample) {
+	for _, remote := range handler.Remotes {
+		if !contains(sample.delivered, remote.Name) {
+			remote.outbox(sample.table).Notify(sample.timestamp)
+		}
+	}
 }
 
-//sendPollutant sending pollutant to remote MQTT broker
-func (handler *Handler) sendPollutant(data []byte) error {
-	token := handler.RemoteMqttClient.Publish(handler.PollutantTopic, handler.config.Mqtt.Qos, false, data)
-	return handler.pubTokenHandler(token)
+//contains check whether the name is in the list
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
-//mqttResponse send respond for resend request
-func (handler *Handler) mqttResponse(topic string, msg string, success bool) {
-	message := make(map[string]interface{})
-	message["suceess"] = success
-	message["message"] = msg
-	payload, _ := json.Marshal(message)
-	token := handler.RemoteMqttClient.Publish(
+//mqttResponse publish the response of a resend request in JSON
+func (handler *Handler) mqttResponse(transport Transport, topic string, response ResendResponse) {
+	payload, _ := json.Marshal(response)
+	err := transport.Publish(
 		topic,
-		handler.config.Mqtt.Qos,
+		handler.conf().Mqtt.Qos,
 		false,
 		payload,
 	)
-	handler.pubTokenHandler(token)
+	if err != nil {
+		handler.MainLogger.Errorf("Error when publish response to %v:%v", topic, err)
+	}
 }
 
-//subTokenHandler is the handler for MQTT subscribe token
-func (handler *Handler) subTokenHandler(token mqtt.Token, topic string) {
-	for !token.WaitTimeout(5 * time.Second) {
-	}
-	if err := token.Error(); err != nil {
+//subscribe subscribe to the topic with the transport and log the result
+func (handler *Handler) subscribe(transport Transport, topic string, callback MessageHandler) {
+	if err := transport.Subscribe(topic, 0, callback); err != nil {
 		handler.MainLogger.Errorf("Error when subscribe to %v:%v", topic, err)
 	} else {
 		handler.MainLogger.Infof("Subscribe to %v", topic)
 	}
 }
 
-//pubTokenHandler is the handler for MQTT publish token
-func (handler *Handler) pubTokenHandler(token mqtt.Token) error {
-	for !token.WaitTimeout(5 * time.Second) {
+//startOutboxes start the outboxes of the tables being sent which are not started yet, e.g. when the set command
+//enables sending a table
+func (handler *Handler) startOutboxes() {
+	conf := handler.conf()
+	for _, remote := range handler.Remotes {
+		if conf.Server.SendPollutantData {
+			handler.startOutbox(remote.pollutantOutbox)
+		}
+		if conf.Server.SendRawData {
+			handler.startOutbox(remote.rawOutbox)
+		}
 	}
-	return token.Error()
 }
 
-//Run is main function for Handler to run. It will try to resend with the resending interval
+//startOutbox run the outbox in background unless it is already started
+func (handler *Handler) startOutbox(outbox *Outbox) {
+	if outbox.start() {
+		handler.background(func() {
+			outbox.Run(handler.done)
+		})
+	}
+}
+
+//Run is main function for Handler to run. It starts the outboxes which resend unsent data, the local HTTP API,
+//metrics and heartbeat publishing and the retention policy when they are enabled, and waits until the service is shutting down.
+//Every goroutine started in background is waited for before the store is closed
 func (handler *Handler) Run() {
-	resendTicker := time.NewTicker(time.Minute * time.Duration(handler.config.Mqtt.ResendingInterval))
-	for {
-		select {
-		case <-handler.done:
-			err := handler.DB.Close()
-			if err != nil {
-				handler.MainLogger.Errorf("Unable to close connection with database:%v", err)
-			}
-			return
-		case <-resendTicker.C:
-			if handler.remoteMqttConnected {
-				if handler.config.Server.SendPollutantData {
-					endTime := time.Now().Unix()
-					handler.resendPollutant(0, endTime)
-				}
-				if handler.config.Server.SendRawData {
-					endTime := time.Now().Unix()
-					handler.resendRaw(0, endTime)
-				}
-			} else {
-				handler.MainLogger.Error("Lost internet connection. Cannot perform any resending.")
-			}
+	conf := handler.conf()
+	var server *http.Server
+	if conf.Server.HTTPEnabled {
+		server = handler.serveAPI()
+	}
+	handler.startOutboxes()
+	if conf.Mqtt.MetricsTopic != "" && conf.Mqtt.MetricsInterval > 0 {
+		topic, interval := handler.metricsTopic(), time.Second*time.Duration(conf.Mqtt.MetricsInterval)
+		handler.background(func() {
+			handler.publishMetrics(topic, interval)
+		})
+	}
+	if conf.Mqtt.HeartbeatTopic != "" && conf.Mqtt.HeartbeatInterval > 0 {
+		topic, interval := handler.heartbeatTopic(), time.Second*time.Duration(conf.Mqtt.HeartbeatInterval)
+		handler.background(func() {
+			handler.publishHeartbeat(topic, interval)
+		})
+	}
+	if conf.Server.KeepMonths > 0 || conf.Server.MinFreeMB > 0 {
+		handler.background(func() {
+			handler.runRetention(retentionInterval)
+		})
+	}
+	<-handler.done
+	if server != nil {
+		handler.shutdownAPI(server)
+	}
+	handler.waitJobs()
+	if store := handler.SetStore(nil); store != nil {
+		if err := store.Close(); err != nil {
+			handler.MainLogger.Errorf("Unable to close connection with database:%v", err)
 		}
 	}
 }
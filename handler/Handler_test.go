@@ -1,9 +1,16 @@
 package handler
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"aws.airsence/datasync/config"
+	"github.com/vmihailenco/msgpack"
 )
 
 func TestDate(t *testing.T) {
@@ -29,3 +36,445 @@ func TestDate(t *testing.T) {
 	))
 	fmt.Println(mileStoneTime.Before(date))
 }
+
+//newTestHandler create a handler with fake transports and memory store, both transports are connected
+func newTestHandler(t *testing.T) (*Handler, *fakeTransport, *fakeTransport, *MemoryStore) {
+	conf := config.Config{}
+	conf.Server.LogRaw = true
+	conf.Server.LogPollutant = true
+	conf.Server.SendRawData = true
+	conf.Server.SendPollutantData = true
+	conf.Mqtt.ClientID = "AirSENCE-Dummy"
+	conf.Mqtt.RawTopic = "airsence/AUG/+/raw"
+	conf.Mqtt.PollutantTopic = "airsence/AUG/+/pollutant"
+	conf.Mqtt.ResendRawTopic = "airsence/AUG/+/resendraw"
+	conf.Mqtt.ResendPollutantTopic = "airsence/AUG/+/resendpollutant"
+	conf.Mqtt.ResendingInterval = 1
+	conf.Mqtt.WillTopic = "airsence/AUG/+/will"
+	conf.Mqtt.OnlinePayload = "Device + online."
+	conf.Server.MainFolder = t.TempDir()
+	local := newFakeTransport()
+	remote := newFakeTransport()
+	store := NewMemoryStore(conf.RemoteNames()...)
+	handler := NewHandler(conf, make(chan bool), testLogger(), local, map[string]Transport{config.DefaultRemoteName: remote})
+	handler.SetStore(store)
+	if err := local.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return handler, local, remote, store
+}
+
+func pollutantPayload(ts int64) []byte {
+	payload, _ := msgpack.Marshal(PollutantDataMsgPack{
+		DeviceID:      "AirSENCE-Dummy",
+		Timestamp:     ts,
+		GPS:           map[string]float64{"Latitude": -79.0, "Longitude": 41.0},
+		PollutantData: map[string]float64{"NO": 1.5, "NO2": 2.5},
+	})
+	return payload
+}
+
+func TestPollutantForwarding(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	ts := time.Now().Unix()
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	if published := remote.Published(handler.PollutantTopic); len(published) != 1 {
+		t.Fatalf("Expect pollutant forwarded to remote broker, got %v", published)
+	}
+	records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 1, Unsent: config.DefaultRemoteName})
+	if len(records) != 0 {
+		t.Fatalf("Expect forwarded pollutant saved as sent, got %v", records)
+	}
+	raw, _ := msgpack.Marshal(RawDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts, RawData: map[string]float64{"CO": 0.3}})
+	handler.config.Server.SendRawData = false
+	local.Deliver(handler.RawTopic, raw)
+	if published := remote.Published(handler.RawTopic); len(published) != 0 {
+		t.Fatalf("Expect raw data not forwarded, got %v", published)
+	}
+	if records, _ = store.Find(Filter{Table: RawTable, EndDate: ts + 1, Unsent: config.DefaultRemoteName}); len(records) != 1 {
+		t.Fatalf("Expect raw data saved as unsent, got %v", records)
+	}
+}
+
+func TestResendAfterPublishFailure(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	ts := time.Now().Unix()
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts-1))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts, Unsent: config.DefaultRemoteName}); len(records) != 2 {
+		t.Fatalf("Expect 2 unsent pollutant rows, got %v", records)
+	}
+	remote.SetPublishErr(nil)
+	request := fmt.Sprintf(`{"StartDate":%v,"EndDate":%v}`, ts-10, ts)
+	remote.Deliver(handler.ResendPollutantTopic, []byte(request))
+	handler.jobs.Wait()
+	if published := remote.Published(handler.PollutantTopic); len(published) != 2 {
+		t.Fatalf("Expect 2 pollutant rows resent, got %v", published)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts, Unsent: config.DefaultRemoteName}); len(records) != 0 {
+		t.Fatalf("Expect every pollutant row marked sent, got %v", records)
+	}
+	responses := remote.Published(handler.ResendPollutantTopic + "/response")
+	if len(responses) != 1 || !strings.Contains(string(responses[0].payload), "Successfully resend") {
+		t.Fatalf("Unexpected resend response:%v", responses)
+	}
+}
+
+func TestResendBatchPartialProgress(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	handler.config.Mqtt.ResendBatchSize = 2
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	for i := int64(0); i < 5; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	remote.FailOnceAfter(3, fmt.Errorf("network down"))
+	request := fmt.Sprintf(`{"requestId":"42","StartDate":%v,"EndDate":%v}`, ts, ts+10)
+	remote.Deliver(handler.ResendPollutantTopic, []byte(request))
+	handler.jobs.Wait()
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10, Unsent: config.DefaultRemoteName}); len(records) != 2 || records[0].Timestamp != ts+3 {
+		t.Fatalf("Expect the 3 delivered rows marked as sent, got %v unsent", records)
+	}
+	responses := remote.Published(handler.ResendPollutantTopic + "/response")
+	if len(responses) != 1 {
+		t.Fatalf("Expect one resend response, got %v", responses)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(responses[0].payload, &response); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"version":   float64(ResendResponseVersion),
+		"requestId": "42",
+		"success":   false,
+		"code":      float64(http.StatusBadGateway),
+		"table":     PollutantTable,
+		"startDate": float64(ts),
+		"endDate":   float64(ts + 10),
+		"attempted": float64(4),
+		"succeeded": float64(3),
+		"failed":    float64(1),
+		"remaining": float64(2),
+	}
+	for key, value := range expected {
+		if response[key] != value {
+			t.Fatalf("Expect %v to be %v, got response %v", key, value, response)
+		}
+	}
+	month := time.Unix(ts, 0).UTC().Format("200601")
+	if files, _ := json.Marshal(response["files"]); string(files) != fmt.Sprintf(`[{"file":"%v","resent":3}]`, month) {
+		t.Fatalf("Expect camelCase resent count of each file, got %s", files)
+	}
+}
+
+func TestResendInvalidRequest(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	remote.Deliver(handler.ResendRawTopic, []byte(`{"requestId":"1","StartDate":10,"EndDate":1}`))
+	remote.Deliver(handler.ResendRawTopic, []byte(`not json`))
+	local.Deliver(handler.ResendRawTopic, []byte(`{"requestId":"3","Destination":"unknown"}`))
+	responses := remote.Published(handler.ResendRawTopic + "/response")
+	if len(responses) != 2 {
+		t.Fatalf("Expect 2 responses on remote broker, got %v", responses)
+	}
+	localResponses := local.Published(handler.ResendRawTopic + "/response")
+	if len(localResponses) != 1 {
+		t.Fatalf("Expect the response of local request on local broker, got %v", localResponses)
+	}
+	for i, msg := range append(responses, localResponses...) {
+		var response ResendResponse
+		if err := json.Unmarshal(msg.payload, &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Success || response.Code != http.StatusBadRequest || response.Version != ResendResponseVersion {
+			t.Fatalf("Expect bad request, got %+v", response)
+		}
+		if i != 1 && response.RequestID != fmt.Sprint(i+1) {
+			t.Fatalf("Expect request ID echoed, got %+v", response)
+		}
+	}
+}
+
+func TestResendFilters(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	handler.config.Mqtt.ResendBatchSize = 2
+	ts := time.Now().Unix() - 100
+	for i := int64(0); i < 4; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	ozone, _ := msgpack.Marshal(PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts + 4, PollutantData: map[string]float64{"O3": 30}})
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, ozone)
+	remote.SetPublishErr(nil)
+	resend := func(request string) ResendResponse {
+		remote.Deliver(handler.ResendPollutantTopic, []byte(request))
+		handler.jobs.Wait()
+		responses := remote.Published(handler.ResendPollutantTopic + "/response")
+		var response ResendResponse
+		if err := json.Unmarshal(responses[len(responses)-1].payload, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	response := resend(fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"IncludeSent":true,"DryRun":true}`, ts, ts+10))
+	if !response.Success || response.Matched != 5 || response.Attempted != 0 || response.Remaining != 1 {
+		t.Fatalf("Expect 5 rows counted in dry run, got %+v", response)
+	}
+	response = resend(fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"Keys":["NO2"],"IncludeSent":true,"DryRun":true}`, ts, ts+10))
+	if response.Matched != 4 {
+		t.Fatalf("Expect 4 rows with NO2, got %+v", response)
+	}
+
+	//Replay the 3 newest rows, already sent or not, to a replay topic
+	request := fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"IncludeSent":true,"Limit":3,"Order":"desc","Topic":"replay/+"}`, ts, ts+10)
+	response = resend(request)
+	published := remote.Published("replay/AirSENCE-Dummy")
+	if !response.Success || response.Succeeded != 3 || len(published) != 3 {
+		t.Fatalf("Expect 3 rows replayed, got %+v (%v published)", response, len(published))
+	}
+	var first PollutantDataMsgPack
+	if err := msgpack.Unmarshal(published[0].payload, &first); err != nil || first.Timestamp != ts+4 {
+		t.Fatalf("Expect newest row replayed first, got %+v (%v)", first, err)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10, Unsent: config.DefaultRemoteName}); len(records) != 1 {
+		t.Fatalf("Expect rows replayed to another topic not marked as sent, got %v", records)
+	}
+
+	start := time.Now()
+	response = resend(fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"Keys":["O3"],"Rate":20}`, ts, ts+10))
+	if !response.Success || response.Succeeded != 1 || response.Remaining != 0 || time.Since(start) < 40*time.Millisecond {
+		t.Fatalf("Expect the ozone row resent with throttle, got %+v in %v", response, time.Since(start))
+	}
+	if response = resend(`{"StartDate":0,"EndDate":10,"Order":"random"}`); response.Code != http.StatusBadRequest {
+		t.Fatalf("Expect unknown order rejected, got %+v", response)
+	}
+}
+
+func TestMultipleRemotes(t *testing.T) {
+	conf := config.Config{}
+	conf.Server.LogPollutant = true
+	conf.Server.SendPollutantData = true
+	conf.Mqtt.ClientID = "AirSENCE-Dummy"
+	conf.Mqtt.PollutantTopic = "airsence/AUG/+/pollutant"
+	conf.Mqtt.ResendPollutantTopic = "airsence/AUG/+/resendpollutant"
+	conf.Remote = []config.RemoteConfig{
+		{Name: "cloud"},
+		{Name: "customer", PollutantTopic: "customer/+/pollutant", Qos: 1},
+	}
+	local := newFakeTransport()
+	cloud := newFakeTransport()
+	customer := newFakeTransport()
+	store := NewMemoryStore(conf.RemoteNames()...)
+	handler := NewHandler(conf, make(chan bool), testLogger(), local, map[string]Transport{
+		"cloud":    cloud,
+		"customer": customer,
+	})
+	handler.SetStore(store)
+	for _, transport := range []*fakeTransport{local, cloud, customer} {
+		if err := transport.Connect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := time.Now().Unix()
+	customer.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	if published := cloud.Published(handler.PollutantTopic); len(published) != 1 {
+		t.Fatalf("Expect pollutant forwarded to cloud, got %v", published)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts, Unsent: "cloud"}); len(records) != 0 {
+		t.Fatalf("Expect nothing unsent to cloud, got %v", records)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts, Unsent: "customer"}); len(records) != 1 {
+		t.Fatalf("Expect 1 row unsent to customer, got %v", records)
+	}
+
+	//A local resend request for the customer only resends to the customer
+	customer.SetPublishErr(nil)
+	request := fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"Destination":"customer"}`, ts-10, ts)
+	local.Deliver(handler.ResendPollutantTopic, []byte(request))
+	handler.jobs.Wait()
+	if published := customer.Published("customer/AirSENCE-Dummy/pollutant"); len(published) != 1 {
+		t.Fatalf("Expect pollutant resent to customer, got %v", published)
+	}
+	if published := cloud.Published(handler.PollutantTopic); len(published) != 1 {
+		t.Fatalf("Expect nothing resent to cloud, got %v", published)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts, Unsent: "customer"}); len(records) != 0 {
+		t.Fatalf("Expect nothing unsent to customer, got %v", records)
+	}
+	if responses := local.Published(handler.ResendPollutantTopic + "/response"); len(responses) != 1 ||
+		!strings.Contains(string(responses[0].payload), `"success":true`) {
+		t.Fatalf("Expect the response on local broker, got %v", responses)
+	}
+	if responses := cloud.Published(handler.ResendPollutantTopic + "/response"); len(responses) != 0 {
+		t.Fatalf("Expect no response on remote broker for local request, got %v", responses)
+	}
+}
+
+func TestThrottledResendInBackground(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	for i := int64(0); i < 3; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	remote.SetPublishErr(nil)
+
+	//The rate throttles the resend for 1.5 seconds, which should not block the callbacks of the local broker
+	start := time.Now()
+	local.Deliver(handler.ResendPollutantTopic, []byte(fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"Rate":2}`, ts, ts+10)))
+	live := pollutantPayload(time.Now().Unix())
+	local.Deliver(handler.PollutantTopic, live)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expect live sample handled while the resend is throttled, took %v", elapsed)
+	}
+	published := remote.Published(handler.PollutantTopic)
+	if len(published) == 0 || string(published[len(published)-1].payload) != string(live) {
+		t.Fatalf("Expect live sample forwarded, got %v", published)
+	}
+	if responses := local.Published(handler.ResendPollutantTopic + "/response"); len(responses) != 0 {
+		t.Fatalf("Expect no response before the resend finishes, got %v", responses)
+	}
+	handler.jobs.Wait()
+	if responses := local.Published(handler.ResendPollutantTopic + "/response"); len(responses) != 1 ||
+		!strings.Contains(string(responses[0].payload), `"succeeded":3`) {
+		t.Fatalf("Expect the response published once the resend finishes, got %v", responses)
+	}
+}
+
+func TestConcurrentResend(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	handler.config.Mqtt.ResendBatchSize = 2
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	for i := int64(0); i < 20; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	remote.SetPublishErr(nil)
+
+	var wg sync.WaitGroup
+	request := []byte(fmt.Sprintf(`{"StartDate":%v,"EndDate":%v,"Rate":1000}`, ts, ts+100))
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		handler.Remotes[0].pollutantOutbox.Drain()
+	}()
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer wg.Done()
+			remote.Deliver(handler.ResendPollutantTopic, request)
+		}()
+	}
+	wg.Wait()
+	handler.jobs.Wait()
+	if published := remote.Published(handler.PollutantTopic); len(published) != 20 {
+		t.Fatalf("Expect every row resent once, got %v rows resent", len(published))
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 100, Unsent: config.DefaultRemoteName}); len(records) != 0 {
+		t.Fatalf("Expect every row marked sent, got %v", records)
+	}
+}
+
+func TestConcurrentState(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		for i := int64(0); i < 50; i++ {
+			local.Deliver(handler.PollutantTopic, pollutantPayload(time.Now().Unix()-i))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			remote.Lose(fmt.Errorf("connection reset"))
+			handler.SetStore(store)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			handler.status()
+			handler.metricsSnapshot()
+			handler.heartbeat()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			var userconfig config.UserConfig
+			userconfig.Mqtt.ResendBatchSize = i + 1
+			handler.mergeUserConfig(userconfig)
+			handler.flush("")
+		}
+	}()
+	wg.Wait()
+	if !handler.Remotes[0].isConnected() || handler.conf().Mqtt.ResendBatchSize != 20 {
+		t.Fatalf("Unexpected state after concurrent access, connected %v", handler.Remotes[0].isConnected())
+	}
+}
+
+//closeCheckStore is a MemoryStore which blocks the first Find until released and fails the test when it is used after Close
+type closeCheckStore struct {
+	*MemoryStore
+	t       *testing.T
+	lock    sync.Mutex
+	closed  bool
+	once    sync.Once
+	finding chan struct{} //finding is closed when the first Find starts
+	release chan struct{}
+}
+
+func (store *closeCheckStore) Find(filter Filter) ([]Record, error) {
+	store.once.Do(func() {
+		close(store.finding)
+		<-store.release
+	})
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.closed {
+		store.t.Error("Store used after it is closed")
+	}
+	return store.MemoryStore.Find(filter)
+}
+
+func (store *closeCheckStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.closed = true
+	return nil
+}
+
+func TestRunWaitsBeforeClosingStore(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	handler.config.Mqtt.HeartbeatTopic = "airsence/AUG/+/heartbeat"
+	handler.config.Mqtt.HeartbeatInterval = 1
+	checked := &closeCheckStore{MemoryStore: store, t: t, finding: make(chan struct{}), release: make(chan struct{})}
+	handler.SetStore(checked)
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(time.Now().Unix()-100))
+	remote.SetPublishErr(nil)
+
+	stopped := make(chan struct{})
+	go func() {
+		handler.Run()
+		close(stopped)
+	}()
+	<-checked.finding
+	close(handler.done)
+	select {
+	case <-stopped:
+		t.Fatal("Expect Run to wait for the outbox draining the store")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(checked.release)
+	<-stopped
+	if !checked.closed {
+		t.Fatal("Expect store closed after Run stops")
+	}
+}
@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"strings"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+//Heartbeat is published periodically to the remote brokers, so silent sensors can be spotted
+type Heartbeat struct {
+	DeviceID   string
+	Version    string
+	Timestamp  int64
+	Uptime     int64            //Uptime of the service in second
+	Backlog    map[string]int   //Backlog is the number of unsent rows for each remote
+	DiskFree   uint64           //DiskFree is the number of bytes available in the main folder
+	LastSample map[string]int64 //LastSample is the Unix time of the last sample received by table
+}
+
+//heartbeat build the heartbeat of now
+func (handler *Handler) heartbeat() Heartbeat {
+	now := time.Now()
+	conf := handler.conf()
+	heartbeat := Heartbeat{
+		DeviceID:   conf.Mqtt.ClientID,
+		Version:    handler.version,
+		Timestamp:  now.Unix(),
+		Uptime:     int64(now.Sub(handler.started) / time.Second),
+		Backlog:    make(map[string]int),
+		LastSample: handler.Metrics.LastSample(),
+	}
+	if store := handler.Store(); store != nil {
+		for _, remote := range handler.Remotes {
+			for _, table := range []string{RawTable, PollutantTable} {
+				count, err := store.CountUnsent(remote.Name, table, 0, heartbeat.Timestamp)
+				if err != nil {
+					handler.MainLogger.Errorf("Error when count unsent %v of %v:%v", table, remote.Name, err)
+					continue
+				}
+				heartbeat.Backlog[remote.Name] += count
+			}
+		}
+	}
+	free, err := diskFree(conf.Server.MainFolder)
+	if err != nil {
+		handler.MainLogger.Errorf("Unable to get free space of %v:%v", conf.Server.MainFolder, err)
+	}
+	heartbeat.DiskFree = free
+	return heartbeat
+}
+
+//publishHeartbeat publish the heartbeat in JSON to every connected remote every interval until done is closed
+func (handler *Handler) publishHeartbeat(topic string, interval time.Duration) {
+	handler.publishEvery(topic, interval, func() interface{} {
+		return handler.heartbeat()
+	})
+}
+
+//publishOnline publish the retained online status of the remote to its will topic, which the will overwrites
+//when the connection is lost
+func (handler *Handler) publishOnline(remote *Remote) {
+	remote.lock.RLock()
+	topic, payload := remote.WillTopic, remote.OnlinePayload
+	remote.lock.RUnlock()
+	if topic == "" || payload == "" || remote.Type != config.RemoteTypeMqtt {
+		return
+	}
+	if err := remote.Transport.Publish(topic, remote.Qos, true, []byte(payload)); err != nil {
+		handler.MainLogger.Errorf("Error when publish online status to %v:%v", remote.Name, err)
+	}
+}
+
+//heartbeatTopic return the topic for publishing heartbeat with "+" replaced by the client ID
+func (handler *Handler) heartbeatTopic() string {
+	conf := handler.conf()
+	return strings.Replace(conf.Mqtt.HeartbeatTopic, "+", conf.Mqtt.ClientID, 1)
+}
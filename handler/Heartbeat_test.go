@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOnlineStatus(t *testing.T) {
+	_, _, remote, _ := newTestHandler(t)
+	published := remote.Published("airsence/AUG/AirSENCE-Dummy/will")
+	if len(published) != 1 || !published[0].retained || string(published[0].payload) != "Device AirSENCE-Dummy online." {
+		t.Fatalf("Expect retained online status on connect, got %v", published)
+	}
+	remote.Lose(fmt.Errorf("connection reset"))
+	if published = remote.Published("airsence/AUG/AirSENCE-Dummy/will"); len(published) != 2 {
+		t.Fatalf("Expect online status published again on reconnect, got %v", published)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	handler.version = "v1.2.3"
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	remote.SetPublishErr(nil)
+
+	stopped := make(chan bool)
+	go func() {
+		handler.publishHeartbeat("airsence/AUG/AirSENCE-Dummy/heartbeat", 10*time.Millisecond)
+		close(stopped)
+	}()
+	defer func() {
+		close(handler.done)
+		<-stopped
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		published := remote.Published("airsence/AUG/AirSENCE-Dummy/heartbeat")
+		if len(published) == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		var heartbeat Heartbeat
+		if err := json.Unmarshal(published[0].payload, &heartbeat); err != nil {
+			t.Fatal(err)
+		}
+		if heartbeat.DeviceID != "AirSENCE-Dummy" || heartbeat.Version != "v1.2.3" || heartbeat.Backlog["default"] != 1 {
+			t.Fatalf("Unexpected heartbeat:%+v", heartbeat)
+		}
+		if heartbeat.DiskFree == 0 || heartbeat.LastSample[PollutantTable] < ts || heartbeat.LastSample[RawTable] != 0 {
+			t.Fatalf("Unexpected heartbeat:%+v", heartbeat)
+		}
+		return
+	}
+	t.Fatal("Expect heartbeat published to remote broker")
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//Limiter is a token bucket limiting the messages and bytes per second resent to a remote. The bucket holds
+//one second of tokens. Live messages take their tokens without waiting, even below zero, so the backlog only
+//gets the bandwidth left by live traffic. A nil Limiter does not limit anything
+type Limiter struct {
+	lock     sync.Mutex
+	rate     float64 //rate is the number of messages per second, no limit when 0
+	byteRate float64 //byteRate is the number of bytes per second, no limit when 0
+	messages float64 //messages is the number of message tokens available
+	bytes    float64 //bytes is the number of byte tokens available
+	last     time.Time
+}
+
+//NewLimiter create the limiter with full bucket, it returns nil when neither rate is set
+func NewLimiter(rate float64, byteRate float64) *Limiter {
+	if rate <= 0 && byteRate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:     math.Max(rate, 0),
+		byteRate: math.Max(byteRate, 0),
+		messages: rate,
+		bytes:    byteRate,
+		last:     time.Now(),
+	}
+}
+
+//refill add the tokens for the time passed since last refill, up to one second of tokens. The lock should be held
+func (limiter *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(limiter.last).Seconds()
+	limiter.last = now
+	limiter.messages = math.Min(limiter.messages+elapsed*limiter.rate, limiter.rate)
+	limiter.bytes = math.Min(limiter.bytes+elapsed*limiter.byteRate, limiter.byteRate)
+}
+
+//Take take the tokens of a live message of the size without waiting
+func (limiter *Limiter) Take(size int) {
+	if limiter == nil {
+		return
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.refill(time.Now())
+	limiter.messages--
+	limiter.bytes -= float64(size)
+}
+
+//Wait wait until there are tokens for the messages of the size in total and take them. More tokens than the
+//bucket holds are taken once the bucket is full. It returns false when done is closed before that
+func (limiter *Limiter) Wait(done <-chan bool, messages int, size int) bool {
+	if limiter == nil {
+		return true
+	}
+	for {
+		limiter.lock.Lock()
+		limiter.refill(time.Now())
+		wait := tokenDelay(limiter.messages, math.Min(float64(messages), limiter.rate), limiter.rate)
+		if byteWait := tokenDelay(limiter.bytes, math.Min(float64(size), limiter.byteRate), limiter.byteRate); byteWait > wait {
+			wait = byteWait
+		}
+		if wait <= 0 {
+			limiter.messages -= float64(messages)
+			limiter.bytes -= float64(size)
+			limiter.lock.Unlock()
+			return true
+		}
+		limiter.lock.Unlock()
+		select {
+		case <-done:
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+//tokenDelay return the time to wait until the tokens available reach needed at the rate, 0 when there is no limit
+func tokenDelay(available float64, needed float64, rate float64) time.Duration {
+	if rate <= 0 || available >= needed {
+		return 0
+	}
+	return time.Duration((needed - available) / rate * float64(time.Second))
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	limiter := NewLimiter(100, 0)
+	done := make(chan bool)
+	start := time.Now()
+	if !limiter.Wait(done, 100, 0) || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("Expect a full bucket taken without waiting, took %v", time.Since(start))
+	}
+	for i := 0; i < 10; i++ {
+		limiter.Take(0)
+	}
+	start = time.Now()
+	if !limiter.Wait(done, 1, 0) || time.Since(start) < 80*time.Millisecond {
+		t.Fatalf("Expect resend waiting for tokens taken by live messages, took %v", time.Since(start))
+	}
+	close(done)
+	limiter.Take(0)
+	if limiter.Wait(done, 100, 0) {
+		t.Fatal("Expect waiting stopped when done is closed")
+	}
+}
+
+func TestLimiterByteRate(t *testing.T) {
+	limiter := NewLimiter(0, 1000)
+	done := make(chan bool)
+	start := time.Now()
+	if !limiter.Wait(done, 10, 1000) || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("Expect a full bucket taken without waiting, took %v", time.Since(start))
+	}
+	start = time.Now()
+	if !limiter.Wait(done, 1, 100) || time.Since(start) < 80*time.Millisecond {
+		t.Fatalf("Expect 100 bytes waiting for 100ms, took %v", time.Since(start))
+	}
+	var unlimited *Limiter
+	unlimited.Take(100)
+	if !unlimited.Wait(done, 1000, 1000000) || NewLimiter(0, 0) != nil {
+		t.Fatal("Expect no limit without rate")
+	}
+}
+
+func TestResendRateLimit(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	for i := int64(0); i < 5; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	remote.SetPublishErr(nil)
+	handler.Remotes[0].limiter = NewLimiter(10, 0)
+	for i := int64(0); i < 10; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+10+i))
+	}
+
+	start := time.Now()
+	result, err := handler.resendTable(handler.Remotes[0], PollutantTable, ResendRequest{EndDate: ts + 100})
+	if err != nil || result.Succeeded != 5 {
+		t.Fatalf("Expect 5 rows resent, got %+v (%v)", result, err)
+	}
+	if time.Since(start) < 400*time.Millisecond {
+		t.Fatalf("Expect resend waiting for the bucket used by live data, took %v", time.Since(start))
+	}
+}
+
+func TestLiveDuringRateLimitedResend(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	for i := int64(0); i < 6; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(ts+i))
+	}
+	remote.SetPublishErr(nil)
+	handler.Remotes[0].limiter = NewLimiter(4, 0)
+	for i := 0; i < 4; i++ {
+		handler.Remotes[0].limiter.Take(0)
+	}
+
+	//The resend waits for the empty bucket, while live samples keep being forwarded without waiting
+	local.Deliver(handler.ResendPollutantTopic, []byte(fmt.Sprintf(`{"StartDate":%v,"EndDate":%v}`, ts, ts+10)))
+	start := time.Now()
+	for i := int64(0); i < 3; i++ {
+		local.Deliver(handler.PollutantTopic, pollutantPayload(time.Now().Unix()+i))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expect live samples not stalled behind the resend, took %v", elapsed)
+	}
+	if published := remote.Published(handler.PollutantTopic); len(published) != 3 {
+		t.Fatalf("Expect only the live samples forwarded while the resend waits, got %v", len(published))
+	}
+	handler.jobs.Wait()
+	if published := remote.Published(handler.PollutantTopic); len(published) != 9 {
+		t.Fatalf("Expect the backlog resent after the live samples, got %v", len(published))
+	}
+}
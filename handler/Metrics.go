@@ -0,0 +1,331 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+//Metrics count the samples processed by the handler. It is safe for concurrent use
+type Metrics struct {
+	lock        sync.Mutex
+	received    map[string]int64 //received is the number of samples received from local MQTT broker by table
+	saved       map[string]int64 //saved is the number of samples saved into the store by table
+	saveFailed  map[string]int64 //saveFailed is the number of samples failed to be saved by table
+	quarantined map[string]int64 //quarantined is the number of invalid messages quarantined by table
+	lastSample  map[string]int64 //lastSample is the Unix time of the last sample received by table
+	remotes     map[string]*remoteCounters
+}
+
+//remoteCounters are the counters of one remote destination, by table
+type remoteCounters struct {
+	forwarded map[string]int64
+	failed    map[string]int64
+	resent    map[string]int64
+	lastSend  int64
+}
+
+//MetricsSnapshot is the value of every metric at a moment
+type MetricsSnapshot struct {
+	Timestamp      int64
+	LocalConnected bool
+	DatabaseOpen   bool
+	Buffered       int   //Buffered is the number of samples buffered in memory while the database is unavailable
+	BufferDropped  int64 //BufferDropped is the number of samples dropped because the buffer is full
+	Received       map[string]int64
+	Saved          map[string]int64
+	SaveFailed     map[string]int64
+	Quarantined    map[string]int64 //Quarantined is the number of invalid messages quarantined into the dead letters
+	LastSample     map[string]int64
+	Remotes        map[string]RemoteMetrics
+}
+
+//RemoteMetrics is the value of the metrics of one remote destination. Counters are by table
+type RemoteMetrics struct {
+	Connected bool
+	Forwarded map[string]int64
+	Failed    map[string]int64
+	Resent    map[string]int64
+	Unsent    map[string]int
+	LastSend  int64 //LastSend is the Unix time of the last successful send, 0 when nothing is sent yet
+}
+
+//NewMetrics create the metrics with every counter at 0
+func NewMetrics() *Metrics {
+	return &Metrics{
+		received:    make(map[string]int64),
+		saved:       make(map[string]int64),
+		saveFailed:  make(map[string]int64),
+		quarantined: make(map[string]int64),
+		lastSample:  make(map[string]int64),
+		remotes:     make(map[string]*remoteCounters),
+	}
+}
+
+//remote return the counters of the remote, the lock should be held
+func (metrics *Metrics) remote(name string) *remoteCounters {
+	counters, ok := metrics.remotes[name]
+	if !ok {
+		counters = &remoteCounters{
+			forwarded: make(map[string]int64),
+			failed:    make(map[string]int64),
+			resent:    make(map[string]int64),
+		}
+		metrics.remotes[name] = counters
+	}
+	return counters
+}
+
+//Received count a sample of the table received from local MQTT broker
+func (metrics *Metrics) Received(table string) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.received[table]++
+	metrics.lastSample[table] = time.Now().Unix()
+}
+
+//LastSample return the Unix time of the last sample received of every table, 0 when nothing is received yet
+func (metrics *Metrics) LastSample() map[string]int64 {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	return copyCounters(metrics.lastSample)
+}
+
+//Saved count a sample of the table saved into the store, or failed to be saved
+func (metrics *Metrics) Saved(table string, err error) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if err != nil {
+		metrics.saveFailed[table]++
+	} else {
+		metrics.saved[table]++
+	}
+}
+
+//Quarantined count an invalid message of the table quarantined into the dead letters
+func (metrics *Metrics) Quarantined(table string) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.quarantined[table]++
+}
+
+//Forwarded count a live sample of the table sent to the remote, or failed to be sent
+func (metrics *Metrics) Forwarded(remote string, table string, err error) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	counters := metrics.remote(remote)
+	if err != nil {
+		counters.failed[table]++
+		return
+	}
+	counters.forwarded[table]++
+	counters.lastSend = time.Now().Unix()
+}
+
+//Resent count the rows of the table resent to the remote, or failed to be resent
+func (metrics *Metrics) Resent(remote string, table string, rows int, err error) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	counters := metrics.remote(remote)
+	if err != nil {
+		counters.failed[table] += int64(rows)
+		return
+	}
+	counters.resent[table] += int64(rows)
+	counters.lastSend = time.Now().Unix()
+}
+
+//snapshot copy the counters into the snapshot
+func (metrics *Metrics) snapshot(snapshot *MetricsSnapshot) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	snapshot.Received = copyCounters(metrics.received)
+	snapshot.Saved = copyCounters(metrics.saved)
+	snapshot.SaveFailed = copyCounters(metrics.saveFailed)
+	snapshot.Quarantined = copyCounters(metrics.quarantined)
+	snapshot.LastSample = copyCounters(metrics.lastSample)
+	for name, remote := range snapshot.Remotes {
+		counters := metrics.remote(name)
+		remote.Forwarded = copyCounters(counters.forwarded)
+		remote.Failed = copyCounters(counters.failed)
+		remote.Resent = copyCounters(counters.resent)
+		remote.LastSend = counters.lastSend
+		snapshot.Remotes[name] = remote
+	}
+}
+
+//copyCounters copy the counters of every table, tables without counter are 0
+func copyCounters(counters map[string]int64) map[string]int64 {
+	copied := map[string]int64{RawTable: 0, PollutantTable: 0}
+	for table, value := range counters {
+		copied[table] = value
+	}
+	return copied
+}
+
+//metricsSnapshot take the snapshot of the metrics with the connection state and the number of unsent rows
+func (handler *Handler) metricsSnapshot() MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		Timestamp:      time.Now().Unix(),
+		LocalConnected: handler.isLocalConnected(),
+		Remotes:        make(map[string]RemoteMetrics),
+	}
+	store := handler.Store()
+	snapshot.DatabaseOpen = store != nil
+	snapshot.Buffered = handler.db.Buffered()
+	snapshot.BufferDropped = handler.db.Dropped()
+	for _, remote := range handler.Remotes {
+		metrics := RemoteMetrics{Connected: remote.isConnected()}
+		if store != nil {
+			metrics.Unsent = make(map[string]int)
+			for _, table := range []string{RawTable, PollutantTable} {
+				count, err := store.CountUnsent(remote.Name, table, 0, snapshot.Timestamp)
+				if err != nil {
+					handler.MainLogger.Errorf("Error when count unsent %v of %v:%v", table, remote.Name, err)
+					continue
+				}
+				metrics.Unsent[table] = count
+			}
+		}
+		snapshot.Remotes[remote.Name] = metrics
+	}
+	handler.Metrics.snapshot(&snapshot)
+	return snapshot
+}
+
+//WritePrometheus write the snapshot in Prometheus text exposition format
+func (snapshot MetricsSnapshot) WritePrometheus(w io.Writer) {
+	remotes := make([]string, 0, len(snapshot.Remotes))
+	for name := range snapshot.Remotes {
+		remotes = append(remotes, name)
+	}
+	sort.Strings(remotes)
+	tables := []string{RawTable, PollutantTable}
+
+	writeMetric(w, "datasync_received_total", "counter", "Samples received from local MQTT broker.")
+	for _, table := range tables {
+		fmt.Fprintf(w, "datasync_received_total{table=%q} %v\n", table, snapshot.Received[table])
+	}
+	writeMetric(w, "datasync_saved_total", "counter", "Samples saved into the database.")
+	for _, table := range tables {
+		fmt.Fprintf(w, "datasync_saved_total{table=%q} %v\n", table, snapshot.Saved[table])
+	}
+	writeMetric(w, "datasync_save_failed_total", "counter", "Samples failed to be saved into the database.")
+	for _, table := range tables {
+		fmt.Fprintf(w, "datasync_save_failed_total{table=%q} %v\n", table, snapshot.SaveFailed[table])
+	}
+	writeMetric(w, "datasync_quarantined_total", "counter", "Invalid messages quarantined into the dead letters.")
+	for _, table := range tables {
+		fmt.Fprintf(w, "datasync_quarantined_total{table=%q} %v\n", table, snapshot.Quarantined[table])
+	}
+	remoteCounters := []struct {
+		name   string
+		help   string
+		values func(RemoteMetrics) map[string]int64
+	}{
+		{"datasync_forwarded_total", "Live samples sent to the remote.", func(m RemoteMetrics) map[string]int64 { return m.Forwarded }},
+		{"datasync_failed_total", "Samples failed to be sent to the remote.", func(m RemoteMetrics) map[string]int64 { return m.Failed }},
+		{"datasync_resent_total", "Unsent rows resent to the remote.", func(m RemoteMetrics) map[string]int64 { return m.Resent }},
+	}
+	for _, counter := range remoteCounters {
+		writeMetric(w, counter.name, "counter", counter.help)
+		for _, name := range remotes {
+			values := counter.values(snapshot.Remotes[name])
+			for _, table := range tables {
+				fmt.Fprintf(w, "%v{remote=%q,table=%q} %v\n", counter.name, name, table, values[table])
+			}
+		}
+	}
+	writeMetric(w, "datasync_unsent_rows", "gauge", "Rows in the database not yet delivered to the remote.")
+	for _, name := range remotes {
+		for _, table := range tables {
+			if count, ok := snapshot.Remotes[name].Unsent[table]; ok {
+				fmt.Fprintf(w, "datasync_unsent_rows{remote=%q,table=%q} %v\n", name, table, count)
+			}
+		}
+	}
+	writeMetric(w, "datasync_remote_connected", "gauge", "Whether the remote is connected (1) or not (0).")
+	for _, name := range remotes {
+		fmt.Fprintf(w, "datasync_remote_connected{remote=%q} %v\n", name, boolValue(snapshot.Remotes[name].Connected))
+	}
+	writeMetric(w, "datasync_last_send_timestamp_seconds", "gauge", "Unix time of the last successful send to the remote.")
+	for _, name := range remotes {
+		fmt.Fprintf(w, "datasync_last_send_timestamp_seconds{remote=%q} %v\n", name, snapshot.Remotes[name].LastSend)
+	}
+	writeMetric(w, "datasync_last_sample_timestamp_seconds", "gauge", "Unix time of the last sample received from local MQTT broker.")
+	for _, table := range tables {
+		fmt.Fprintf(w, "datasync_last_sample_timestamp_seconds{table=%q} %v\n", table, snapshot.LastSample[table])
+	}
+	writeMetric(w, "datasync_local_connected", "gauge", "Whether the local MQTT broker is connected (1) or not (0).")
+	fmt.Fprintf(w, "datasync_local_connected %v\n", boolValue(snapshot.LocalConnected))
+	writeMetric(w, "datasync_database_open", "gauge", "Whether the database is open (1) or not (0).")
+	fmt.Fprintf(w, "datasync_database_open %v\n", boolValue(snapshot.DatabaseOpen))
+	writeMetric(w, "datasync_buffered_samples", "gauge", "Samples buffered in memory while the database is unavailable.")
+	fmt.Fprintf(w, "datasync_buffered_samples %v\n", snapshot.Buffered)
+	writeMetric(w, "datasync_buffer_dropped_total", "counter", "Samples dropped because the buffer is full.")
+	fmt.Fprintf(w, "datasync_buffer_dropped_total %v\n", snapshot.BufferDropped)
+}
+
+//writeMetric write the HELP and TYPE lines of the metric
+func writeMetric(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+//boolValue return 1 for true and 0 for false
+func boolValue(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+//publishMetrics publish the metrics snapshot in JSON to every connected remote every interval until done is closed
+func (handler *Handler) publishMetrics(topic string, interval time.Duration) {
+	handler.publishEvery(topic, interval, func() interface{} {
+		return handler.metricsSnapshot()
+	})
+}
+
+//publishEvery publish the value built by build in JSON to every connected remote every interval until done is closed
+func (handler *Handler) publishEvery(topic string, interval time.Duration, build func() interface{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-handler.done:
+			return
+		case <-ticker.C:
+		}
+		payload, err := json.Marshal(build())
+		if err != nil {
+			handler.MainLogger.Errorf("Unable to encode message for %v:%v", topic, err)
+			continue
+		}
+		handler.publishRemotes(topic, false, payload)
+	}
+}
+
+//publishRemotes publish the payload of the service itself (not a sample) to every connected MQTT remote.
+//HTTP remotes only receive samples
+func (handler *Handler) publishRemotes(topic string, retained bool, payload []byte) {
+	for _, remote := range handler.Remotes {
+		if !remote.isConnected() || remote.Type != config.RemoteTypeMqtt {
+			continue
+		}
+		if err := remote.Transport.Publish(topic, remote.Qos, retained, payload); err != nil {
+			handler.MainLogger.Errorf("Error when publish to %v of %v:%v", topic, remote.Name, err)
+		}
+	}
+}
+
+//metricsTopic return the topic for publishing metrics with "+" replaced by the client ID
+func (handler *Handler) metricsTopic() string {
+	conf := handler.conf()
+	return strings.Replace(conf.Mqtt.MetricsTopic, "+", conf.Mqtt.ClientID, 1)
+}
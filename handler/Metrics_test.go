@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+1))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+2))
+	local.Deliver(handler.RawTopic, []byte{0xc1})
+
+	snapshot := handler.metricsSnapshot()
+	metrics := snapshot.Remotes["default"]
+	if snapshot.Received[PollutantTable] != 3 || snapshot.Saved[PollutantTable] != 3 || snapshot.Quarantined[RawTable] != 1 {
+		t.Fatalf("Unexpected counters:%+v", snapshot)
+	}
+	if metrics.Forwarded[PollutantTable] != 1 || metrics.Failed[PollutantTable] != 2 || metrics.Unsent[PollutantTable] != 2 {
+		t.Fatalf("Unexpected remote metrics:%+v", metrics)
+	}
+	if metrics.LastSend == 0 || !metrics.Connected || !snapshot.LocalConnected || !snapshot.DatabaseOpen {
+		t.Fatalf("Unexpected state:%+v", snapshot)
+	}
+
+	remote.SetPublishErr(nil)
+	if _, err := handler.Remotes[0].pollutantOutbox.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	var text bytes.Buffer
+	handler.metricsSnapshot().WritePrometheus(&text)
+	for _, line := range []string{
+		"# TYPE datasync_received_total counter",
+		`datasync_received_total{table="pollutant"} 3`,
+		`datasync_resent_total{remote="default",table="pollutant"} 2`,
+		`datasync_unsent_rows{remote="default",table="pollutant"} 0`,
+		`datasync_remote_connected{remote="default"} 1`,
+		"datasync_database_open 1",
+		"datasync_buffer_dropped_total 0",
+		`datasync_quarantined_total{table="raw"} 1`,
+	} {
+		if !strings.Contains(text.String(), line+"\n") {
+			t.Fatalf("Expect %v in metrics:\n%v", line, text.String())
+		}
+	}
+	if code := apiRequest(t, handler, http.MethodGet, "/metrics", "", nil); code != http.StatusOK {
+		t.Fatalf("Unexpected metrics code %v", code)
+	}
+}
+
+func TestPublishMetrics(t *testing.T) {
+	handler, _, remote, _ := newTestHandler(t)
+	go handler.publishMetrics("airsence/AUG/AirSENCE-Dummy/metrics", 10*time.Millisecond)
+	defer close(handler.done)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if published := remote.Published("airsence/AUG/AirSENCE-Dummy/metrics"); len(published) > 0 {
+			if !strings.Contains(string(published[0].payload), `"DatabaseOpen":true`) {
+				t.Fatalf("Unexpected metrics payload %s", published[0].payload)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expect metrics published to remote broker")
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+//migration upgrade the schema of a database file to its version, which is kept in PRAGMA user_version.
+//Files created before schema versioning are version 0
+type migration struct {
+	version     int
+	description string
+	upgrade     func(tx *sql.Tx) error
+}
+
+//migrations are applied in order to every database file opened for inserting, each one in its own transaction.
+//New migrations are appended with the next version, released migrations should never be changed
+var migrations = []migration{
+	{
+		version:     1,
+		description: "index samples by sent and timestamp",
+		upgrade: func(tx *sql.Tx) error {
+			for _, table := range []string{RawTable, PollutantTable} {
+				stmt := fmt.Sprintf(`create index if not exists %v_sent_ts on %v (sent, ts)`, table, table)
+				if err := execIfTableExist(tx, table, stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "store device ID, GPS and values of samples as columns",
+		upgrade: func(tx *sql.Tx) error {
+			for _, stmt := range []string{valuesTableStmt, valuesKeyIndexStmt} {
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			for _, table := range []string{RawTable, PollutantTable} {
+				//The table failed to be created before migrating would be created without the columns
+				stmts := []string{
+					fmt.Sprintf(sampleTableStmt, table),
+					fmt.Sprintf(`create index if not exists %v_sent_ts on %v (sent, ts)`, table, table),
+				}
+				for _, column := range fieldColumns[table] {
+					stmts = append(stmts, fmt.Sprintf(`alter table %v add column %v`, table, column))
+				}
+				for _, stmt := range stmts {
+					if _, err := tx.Exec(stmt); err != nil {
+						return err
+					}
+				}
+				//The fields of the samples already in the file are saved in background, since a large file
+				//would block inserting for a long time
+				if err := scheduleBackfill(tx, table); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     3,
+		description: "quarantine invalid messages into deadletter table",
+		upgrade: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			create table if not exists deadletter (id integer not null primary key, received timestamp, tbl text, topic text, reason text, data blob);
+			`)
+			return err
+		},
+	},
+}
+
+//schemaVersion is the version of the schema of database files created by this version of the software
+var schemaVersion = migrations[len(migrations)-1].version
+
+//migrate upgrade the database file to schemaVersion and return the version before upgrading.
+//Files of a newer schema, e.g. after the software is downgraded, are left unchanged
+func migrate(db *sql.DB) (int, error) {
+	from, err := userVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	for _, migration := range migrations {
+		if migration.version <= from {
+			continue
+		}
+		if err = migration.apply(db); err != nil {
+			return from, fmt.Errorf("Error when migrate to version %v (%v):%v", migration.version, migration.description, err)
+		}
+	}
+	return from, nil
+}
+
+//apply run the migration in a transaction unless another connection has applied it meanwhile
+func (migration migration) apply(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var version int
+	if err = tx.QueryRow(`pragma user_version`).Scan(&version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if version >= migration.version {
+		return tx.Rollback()
+	}
+	if err = migration.upgrade(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(`pragma user_version = %d`, migration.version)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//userVersion return the schema version of the database file
+func userVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`pragma user_version`).Scan(&version)
+	return version, err
+}
+
+//execIfTableExist execute the statement when the table exists, since older files may not have every table
+func execIfTableExist(tx *sql.Tx, table string, stmt string) error {
+	var exist int
+	if err := tx.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = ?`, table).Scan(&exist); err != nil {
+		return err
+	}
+	if exist == 0 {
+		return nil
+	}
+	_, err := tx.Exec(stmt)
+	return err
+}
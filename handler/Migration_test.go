@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestMigrateOldFiles(t *testing.T) {
+	folder := t.TempDir()
+	store := &SQLiteStore{folder: folder, clientID: "AirSENCE-Dummy", logger: testLogger()}
+	//Files created before schema versioning, the older one without raw table
+	for month, stmt := range map[string]string{
+		"202203": `create table pollutant (id integer not null primary key, ts timestamp,data json,sent bool default false);`,
+		"202204": `create table pollutant (id integer not null primary key, ts timestamp,data json,sent bool default false);
+			create table raw (id integer not null primary key, ts timestamp,data json,sent bool default false);`,
+	} {
+		db, err := sql.Open("sqlite3", store.dbPath(month))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+		if month == "202203" {
+			_, err = db.Exec(`insert into pollutant (ts, data) values (?, ?)`, int64(1646870400), pollutantPayload(1646870400))
+		}
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store, err := NewSQLiteStore(folder, "AirSENCE-Dummy", []string{"default"}, testLogger(), time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	end := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC).Unix()
+	if records, err := store.Find(Filter{Table: PollutantTable, EndDate: end, Unsent: "default"}); err != nil || len(records) != 1 {
+		t.Fatalf("Expect old file readable before migration, got %v (%v)", records, err)
+	}
+	if records, err := store.Find(Filter{Table: PollutantTable, EndDate: end, Keys: []string{"NO2"}}); err != nil || len(records) != 0 {
+		t.Fatalf("Expect no sample selected by key in a file not migrated, got %v (%v)", records, err)
+	}
+	if count, err := store.Purge(1646870400); err != nil || count != 0 {
+		t.Fatalf("Expect old file purged before migration, got %v (%v)", count, err)
+	}
+	//Reading the file of an older month does not migrate it
+	db, err := sql.Open("sqlite3", store.dbPath("202203"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := userVersion(db)
+	backfill, _ := tableExist(db, "backfill")
+	db.Close()
+	if err != nil || version != 0 || backfill {
+		t.Fatalf("Expect file read only not migrated, got version %v with backfill %v (%v)", version, backfill, err)
+	}
+
+	//A late sample opens the file for inserting, which migrates it
+	if err = store.Insert(PollutantTable, 1646870401, pollutantPayload(1646870401), nil); err != nil {
+		t.Fatal(err)
+	}
+	store.backfills.Wait()
+	for month, indexes := range map[string]int{"202203": 2, "202204": 2} {
+		db, err := sql.Open("sqlite3", store.dbPath(month))
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err := userVersion(db)
+		var count int
+		db.QueryRow(`select count(*) from sqlite_master where type = 'index' and name like '%_sent_ts'`).Scan(&count)
+		db.Close()
+		if err != nil || version != schemaVersion || count != indexes {
+			t.Fatalf("Expect %v migrated to version %v with %v indexes, got version %v with %v indexes (%v)", month, schemaVersion, indexes, version, count, err)
+		}
+	}
+
+	//Fields of the samples already in the file are saved as well
+	db, err = sql.Open("sqlite3", store.dbPath("202203"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var deviceID string
+	var latitude float64
+	var values int
+	db.QueryRow(`select device_id, latitude from pollutant where id = 1`).Scan(&deviceID, &latitude)
+	db.QueryRow(`select count(*) from sample_values where tbl = 'pollutant' and id = 1`).Scan(&values)
+	if deviceID != "AirSENCE-Dummy" || latitude != -79 || values != 2 {
+		t.Fatalf("Expect fields of old samples saved in background, got %v %v with %v values", deviceID, latitude, values)
+	}
+	if backfill, err := tableExist(db, "backfill"); err != nil || backfill {
+		t.Fatalf("Expect backfill progress dropped once done, got %v (%v)", backfill, err)
+	}
+	if records, err := store.Find(Filter{Table: PollutantTable, EndDate: end, Keys: []string{"NO2"}}); err != nil || len(records) != 2 {
+		t.Fatalf("Expect old and late samples selected by key after migration, got %v (%v)", records, err)
+	}
+
+	//Migrating again does nothing
+	if from, err := migrate(db); err != nil || from != schemaVersion {
+		t.Fatalf("Expect file already at version %v, got %v (%v)", schemaVersion, from, err)
+	}
+}
+
+func TestBackfillInChunks(t *testing.T) {
+	folder := t.TempDir()
+	store := &SQLiteStore{folder: folder, clientID: "AirSENCE-Dummy", logger: testLogger()}
+	db, err := sql.Open("sqlite3", store.dbPath("202204"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(`create table pollutant (id integer not null primary key, ts timestamp,data json,sent bool default false);`); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	for i := int64(0); i < backfillChunkSize+10; i++ {
+		if _, err = db.Exec(`insert into pollutant (ts, data) values (?, ?)`, ts+i, pollutantPayload(ts+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	//Only the schema is upgraded by the migration, the fields are saved a chunk at a time afterwards
+	var count int
+	db.QueryRow(`select count(*) from pollutant where device_id is not null`).Scan(&count)
+	if count != 0 {
+		t.Fatalf("Expect fields not saved by the migration, got %v", count)
+	}
+	for _, expected := range []int{backfillChunkSize, backfillChunkSize + 10} {
+		if more, err := store.backfillOnce(store.dbPath("202204")); err != nil || !more {
+			t.Fatalf("Expect more samples to backfill, got %v (%v)", more, err)
+		}
+		db.QueryRow(`select count(*) from pollutant where device_id is not null`).Scan(&count)
+		if count != expected {
+			t.Fatalf("Expect fields of %v samples saved, got %v", expected, count)
+		}
+	}
+	if more, err := store.backfillOnce(store.dbPath("202204")); err != nil || more {
+		t.Fatalf("Expect backfill done, got %v (%v)", more, err)
+	}
+}
+
+func TestOpenFailedMigration(t *testing.T) {
+	folder := t.TempDir()
+	store := &SQLiteStore{folder: folder, clientID: "AirSENCE-Dummy", logger: testLogger()}
+	db, err := sql.Open("sqlite3", store.dbPath("202204"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The column added by migration 2 exists already, so the migration fails
+	_, err = db.Exec(`create table pollutant (id integer not null primary key, ts timestamp,data json,sent bool default false,device_id text);
+		pragma user_version = 1;`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSQLiteStore(folder, "AirSENCE-Dummy", []string{"default"}, testLogger(), time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Fatal("Expect database not opened for inserting when migration fails")
+	}
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	outboxMinBackoff = time.Second //outboxMinBackoff is the first retry delay after a failed drain
+)
+
+//Outbox drain rows of one table not delivered to one remote broker, oldest first. It wakes up as soon as the
+//remote connection is established or a sample fails to be sent, and backs off exponentially when
+//sending keeps failing. It keeps a cursor so rows already known as sent are never scanned again
+type Outbox struct {
+	handler    *Handler
+	remote     *Remote
+	table      string
+	wake       chan struct{}
+	maxBackoff time.Duration
+	lock       sync.Mutex
+	cursor     int64 //cursor is the timestamp before which every row is known as sent
+	notified   int64 //notified is the oldest timestamp of unsent rows saved during a drain
+	running    bool  //running is true once the outbox is started
+}
+
+//NewOutbox create the outbox of the table for the remote. The cursor starts from 0, so the first drain scans the whole store
+func NewOutbox(handler *Handler, remote *Remote, table string, maxBackoff time.Duration) *Outbox {
+	if maxBackoff < outboxMinBackoff {
+		maxBackoff = outboxMinBackoff
+	}
+	return &Outbox{
+		handler:    handler,
+		remote:     remote,
+		table:      table,
+		wake:       make(chan struct{}, 1),
+		maxBackoff: maxBackoff,
+		notified:   math.MaxInt64,
+	}
+}
+
+//Wake wake up the outbox to drain unsent rows
+func (outbox *Outbox) Wake() {
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Notify tell the outbox an unsent row with the timestamp is saved and wake it up
+func (outbox *Outbox) Notify(timestamp int64) {
+	outbox.lock.Lock()
+	if timestamp < outbox.cursor {
+		outbox.cursor = timestamp
+	}
+	if timestamp < outbox.notified {
+		outbox.notified = timestamp
+	}
+	outbox.lock.Unlock()
+	outbox.Wake()
+}
+
+//Cursor return the timestamp before which every row is known as sent
+func (outbox *Outbox) Cursor() int64 {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	return outbox.cursor
+}
+
+//start mark the outbox as running and return true, or return false when it is already started
+func (outbox *Outbox) start() bool {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	if outbox.running {
+		return false
+	}
+	outbox.running = true
+	return true
+}
+
+//Run drain the outbox whenever it is woken up until done is closed. After a failed drain
+//it retries with exponential backoff
+func (outbox *Outbox) Run(done <-chan bool) {
+	backoff := time.Duration(0)
+	retry := time.NewTimer(time.Hour)
+	retry.Stop()
+	outbox.Wake()
+	for {
+		select {
+		case <-done:
+			retry.Stop()
+			return
+		case <-outbox.wake:
+		case <-retry.C:
+		}
+		sent, err := outbox.Drain()
+		if err == nil {
+			if sent > 0 {
+				outbox.handler.MainLogger.Infof("Outbox resent %v %v rows to %v", sent, outbox.table, outbox.remote.Name)
+			}
+			backoff = 0
+			continue
+		}
+		if backoff == 0 {
+			backoff = outboxMinBackoff
+		} else if backoff *= 2; backoff > outbox.maxBackoff {
+			backoff = outbox.maxBackoff
+		}
+		outbox.handler.MainLogger.Errorf(
+			"Outbox fail to resend %v to %v, retry in %v:%v",
+			outbox.table,
+			outbox.remote.Name,
+			backoff,
+			err,
+		)
+		retry.Stop()
+		retry.Reset(backoff)
+	}
+}
+
+//Drain send every unsent row after the cursor oldest first and mark them as sent.
+//On failure, the rows sent so far are marked and the cursor stops at the failed row
+func (outbox *Outbox) Drain() (int, error) {
+	outbox.lock.Lock()
+	from := outbox.cursor
+	outbox.notified = math.MaxInt64
+	outbox.lock.Unlock()
+	until := time.Now().Unix()
+	result, err := outbox.handler.resendTable(outbox.remote, outbox.table, ResendRequest{StartDate: from, EndDate: until})
+	next := until + 1
+	if result.Failed > 0 {
+		next = result.failedAt
+	} else if err != nil {
+		next = from
+	}
+	outbox.lock.Lock()
+	if outbox.notified < next {
+		next = outbox.notified
+	}
+	outbox.cursor = next
+	outbox.lock.Unlock()
+	return result.Succeeded, err
+}
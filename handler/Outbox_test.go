@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestOutboxDrainOldestFirst(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+2))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+1))
+	if cursor := handler.Remotes[0].pollutantOutbox.Cursor(); cursor != 0 {
+		t.Fatalf("Expect cursor to stay at 0 before first drain, got %v", cursor)
+	}
+
+	//Partial failure marks the delivered row and stops the cursor at the failed one
+	remote.FailOnceAfter(1, fmt.Errorf("network down"))
+	if sent, err := handler.Remotes[0].pollutantOutbox.Drain(); err == nil || sent != 1 {
+		t.Fatalf("Expect drain to fail after 1 row, got %v (%v)", sent, err)
+	}
+	if cursor := handler.Remotes[0].pollutantOutbox.Cursor(); cursor != ts+1 {
+		t.Fatalf("Expect cursor at failed row %v, got %v", ts+1, cursor)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 2, Unsent: config.DefaultRemoteName}); len(records) != 2 {
+		t.Fatalf("Expect 2 unsent rows after partial drain, got %v", records)
+	}
+
+	if sent, err := handler.Remotes[0].pollutantOutbox.Drain(); err != nil || sent != 2 {
+		t.Fatalf("Expect drain to send 2 rows, got %v (%v)", sent, err)
+	}
+	published := remote.Published(handler.PollutantTopic)
+	if len(published) != 3 {
+		t.Fatalf("Expect 3 rows published, got %v", len(published))
+	}
+	for i, msg := range published {
+		var data PollutantDataMsgPack
+		if err := msgpack.Unmarshal(msg.payload, &data); err != nil || data.Timestamp != ts+int64(i) {
+			t.Fatalf("Expect rows published oldest first, row %v is %v", i, data)
+		}
+	}
+	if cursor := handler.Remotes[0].pollutantOutbox.Cursor(); cursor <= ts+2 {
+		t.Fatalf("Expect cursor after every sent row, got %v", cursor)
+	}
+
+	//An older unsent row saved later moves the cursor back
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts-50))
+	if cursor := handler.Remotes[0].pollutantOutbox.Cursor(); cursor != ts-50 {
+		t.Fatalf("Expect cursor moved back to %v, got %v", ts-50, cursor)
+	}
+}
+
+func TestOutboxWakeOnReconnect(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	done := make(chan bool)
+	defer close(done)
+	go handler.Remotes[0].pollutantOutbox.Run(done)
+	ts := time.Now().Unix()
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	remote.Lose(fmt.Errorf("connection reset"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	remote.SetPublishErr(nil)
+	remote.Lose(fmt.Errorf("connection reset"))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts, Unsent: config.DefaultRemoteName}); len(records) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expect outbox to drain unsent row after reconnect")
+}
@@ -0,0 +1,327 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+//storageErrors are the messages of errors which mean the main folder is read-only or the SD card is failing
+var storageErrors = []string{
+	"read-only file system",
+	"readonly database",
+	"disk i/o error",
+	"input/output error",
+}
+
+//CommandRunner run an external command and return its combined output. It is replaced by a fake runner in tests
+type CommandRunner interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+//execRunner is the CommandRunner running commands with os/exec
+type execRunner struct{}
+
+func (execRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+//recovery is the state of the recovery of the main folder. It is safe for concurrent use
+type recovery struct {
+	lock     sync.Mutex
+	running  bool  //running is true while a goroutine is recovering the main folder
+	fallback Store //fallback is the store in FallbackFolder in use while the main folder is not writable
+}
+
+//isStorageError check whether the error is a read-only file system or I/O error of the main folder
+func isStorageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	errString := strings.ToLower(err.Error())
+	for _, message := range storageErrors {
+		if strings.Contains(errString, message) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkStorageError start recovering the main folder in background when the error of the store is a
+//read-only file system or I/O error. Nothing is done when a recovery is already running
+func (handler *Handler) checkStorageError(err error) {
+	if !isStorageError(err) {
+		return
+	}
+	handler.recovery.lock.Lock()
+	defer handler.recovery.lock.Unlock()
+	if handler.recovery.running {
+		return
+	}
+	handler.MainLogger.Warnf("Storage error of main folder, start recovery:%v", err)
+	handler.recovery.running = true
+	go handler.recoverStorage()
+}
+
+//usingFallback check whether samples are saved in the fallback folder
+func (handler *Handler) usingFallback() bool {
+	handler.recovery.lock.Lock()
+	defer handler.recovery.lock.Unlock()
+	return handler.recovery.fallback != nil
+}
+
+//recoverStorage retry recovering the main folder every RecoveryInterval until the database of the main folder
+//is open again or the service is shutting down
+func (handler *Handler) recoverStorage() {
+	defer func() {
+		handler.recovery.lock.Lock()
+		handler.recovery.running = false
+		handler.recovery.lock.Unlock()
+	}()
+	for !handler.recoverOnce(time.Now()) {
+		interval := handler.conf().Server.RecoveryInterval
+		if interval <= 0 {
+			interval = config.DefaultRecoveryInterval
+		}
+		if !handler.sleep(time.Duration(interval) * time.Second) {
+			return
+		}
+	}
+}
+
+//recoverOnce run the recovery commands and open the database of the main folder again when it is writable.
+//Samples saved in the fallback folder meanwhile are merged back. When the main folder is still not writable,
+//the fallback store is used if FallbackFolder is configured. It returns true when the main folder is in use
+func (handler *Handler) recoverOnce(date time.Time) bool {
+	handler.runRecoveryCommands()
+	conf := handler.conf()
+	store, err := handler.openMainStore(date)
+	if err == nil {
+		handler.MainLogger.Infof("Main folder %v recovered", conf.Server.MainFolder)
+		handler.switchStore(store)
+		handler.recovery.lock.Lock()
+		fallback := handler.recovery.fallback
+		handler.recovery.fallback = nil
+		handler.recovery.lock.Unlock()
+		if fallback != nil {
+			if err := fallback.Close(); err != nil {
+				handler.MainLogger.Errorf("Unable to close connection with fallback database:%v", err)
+			}
+			handler.mergeFallback(fallback, handler.Store())
+		}
+		return true
+	}
+	handler.MainLogger.Errorf("Main folder %v is not writable:%v", conf.Server.MainFolder, err)
+	handler.recovery.lock.Lock()
+	fallback := handler.recovery.fallback
+	handler.recovery.lock.Unlock()
+	if conf.Server.FallbackFolder == "" || fallback != nil {
+		return false
+	}
+	opened, err := NewSQLiteStore(
+		conf.Server.FallbackFolder,
+		conf.Mqtt.ClientID,
+		conf.RemoteNames(),
+		handler.MainLogger,
+		date,
+	)
+	if err == nil {
+		err = writable(conf.Server.FallbackFolder)
+	}
+	if err != nil {
+		handler.MainLogger.Errorf("Unable to open database in fallback folder %v:%v", conf.Server.FallbackFolder, err)
+		return false
+	}
+	handler.MainLogger.Warnf("Saving samples in fallback folder %v until main folder is recovered", conf.Server.FallbackFolder)
+	handler.recovery.lock.Lock()
+	handler.recovery.fallback = opened
+	handler.recovery.lock.Unlock()
+	handler.switchStore(opened)
+	return false
+}
+
+//runRecoveryCommands run every recovery command in order with [Device] and [MainFolder] replaced.
+//A failed command is logged and the next one is still run
+func (handler *Handler) runRecoveryCommands() {
+	server := handler.conf().Server
+	replacer := strings.NewReplacer("[Device]", server.RecoveryDevice, "[MainFolder]", server.MainFolder)
+	for _, command := range server.RecoveryCommands {
+		args := strings.Fields(replacer.Replace(command))
+		if len(args) == 0 {
+			continue
+		}
+		output, err := handler.runner.Run(args[0], args[1:]...)
+		if err != nil {
+			handler.MainLogger.Errorf("Recovery command %v failed:%v %s", strings.Join(args, " "), err, output)
+			continue
+		}
+		handler.MainLogger.Infof("Recovery command %v done", strings.Join(args, " "))
+	}
+}
+
+//openMainStore open the default SQLite store in the main folder after checking the folder is writable,
+//since SQLite does not write anything until the first insert
+func (handler *Handler) openMainStore(date time.Time) (Store, error) {
+	if err := writable(handler.conf().Server.MainFolder); err != nil {
+		return nil, err
+	}
+	return handler.openStore(date)
+}
+
+//writable check whether a file can be written in the folder
+func writable(folder string) error {
+	file, err := ioutil.TempFile(folder, ".datasync-")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte("datasync"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+//switchStore replace the store without closing the database in between, so samples received meanwhile are not
+//buffered, then close the previous store and flush the samples buffered into the new one
+func (handler *Handler) switchStore(store Store) {
+	if previous := handler.db.Set(store); previous != nil && previous != store {
+		if err := previous.Close(); err != nil {
+			handler.MainLogger.Errorf("Unable to close connection with database:%v", err)
+		}
+	}
+	handler.flushBuffer(store)
+}
+
+//mergeFallback copy every sample of the fallback store into the store with the remotes it was delivered to,
+//and every dead letter as well, then remove the partitions of the fallback store. The fallback store should be closed already.
+//When a sample fails to be merged, the fallback files are kept and merged with the samples of the next fallback.
+//Samples already in the store, merged before the failure, are skipped, so merging again does not duplicate them
+func (handler *Handler) mergeFallback(fallback Store, store Store) {
+	if store == nil {
+		handler.MainLogger.Error("Unable to merge fallback database:Database not connected")
+		return
+	}
+	remotes := handler.conf().RemoteNames()
+	merged, skipped := 0, 0
+	for _, table := range []string{RawTable, PollutantTable} {
+		//Destinations which did not receive each record, keyed by partition and ID
+		unsent := make(map[string][]string)
+		for _, remote := range remotes {
+			records, err := fallback.Find(Filter{Table: table, EndDate: math.MaxInt64, Unsent: remote})
+			if err != nil {
+				handler.MainLogger.Errorf("Error when read fallback database:%v", err)
+				return
+			}
+			for _, record := range records {
+				key := fmt.Sprintf("%v/%v", record.Partition, record.ID)
+				unsent[key] = append(unsent[key], remote)
+			}
+		}
+		records, err := fallback.Find(Filter{Table: table, EndDate: math.MaxInt64})
+		if err != nil {
+			handler.MainLogger.Errorf("Error when read fallback database:%v", err)
+			return
+		}
+		for _, record := range records {
+			exist, err := hasRecord(store, table, record)
+			if err != nil {
+				handler.checkStorageError(err)
+				handler.MainLogger.Errorf("Error when merge fallback database, %v samples merged:%v", merged, err)
+				return
+			}
+			if exist {
+				skipped++
+				continue
+			}
+			var delivered []string
+			for _, remote := range remotes {
+				if !contains(unsent[fmt.Sprintf("%v/%v", record.Partition, record.ID)], remote) {
+					delivered = append(delivered, remote)
+				}
+			}
+			if err := store.Insert(table, record.Timestamp, record.Data, delivered); err != nil {
+				handler.checkStorageError(err)
+				handler.MainLogger.Errorf("Error when merge fallback database, %v samples merged:%v", merged, err)
+				return
+			}
+			handler.notify(pendingSample{table: table, timestamp: record.Timestamp, delivered: delivered})
+			merged++
+		}
+	}
+	letters, err := fallback.DeadLetters(0, math.MaxInt64, 0)
+	if err != nil {
+		handler.MainLogger.Errorf("Error when read fallback dead letters:%v", err)
+		return
+	}
+	lettersMerged := 0
+	for _, letter := range letters {
+		exist, err := hasDeadLetter(store, letter)
+		if err == nil && !exist {
+			if err = store.Quarantine(letter); err == nil {
+				lettersMerged++
+			}
+		}
+		if err != nil {
+			handler.checkStorageError(err)
+			handler.MainLogger.Errorf("Error when merge fallback dead letters, %v samples merged:%v", merged, err)
+			return
+		}
+	}
+	partitions, err := fallback.Partitions()
+	if err != nil {
+		handler.MainLogger.Errorf("Error when list fallback database files:%v", err)
+	}
+	for _, partition := range partitions {
+		if _, err := fallback.RemovePartition(partition.Name); err != nil {
+			handler.MainLogger.Errorf("Error when remove fallback database file %v:%v", partition.Name, err)
+		}
+	}
+	handler.MainLogger.Infof(
+		"Merged %v samples and %v dead letters from fallback folder into main folder, %v samples already merged",
+		merged,
+		lettersMerged,
+		skipped,
+	)
+}
+
+//hasRecord check whether the store has a sample of the table with the same timestamp and data as the record
+func hasRecord(store Store, table string, record Record) (bool, error) {
+	records, err := store.Find(Filter{Table: table, StartDate: record.Timestamp, EndDate: record.Timestamp})
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range records {
+		if bytes.Equal(existing.Data, record.Data) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//hasDeadLetter check whether the store has a dead letter received at the same time with the same message and reason
+func hasDeadLetter(store Store, letter DeadLetter) (bool, error) {
+	letters, err := store.DeadLetters(letter.Received, letter.Received, 0)
+	if err != nil {
+		return false, err
+	}
+	for _, existing := range letters {
+		if existing.Table == letter.Table &&
+			existing.Topic == letter.Topic &&
+			existing.Reason == letter.Reason &&
+			bytes.Equal(existing.Data, letter.Data) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+//fakeRunner record the commands run and call fix for each of them instead of running them
+type fakeRunner struct {
+	lock     sync.Mutex
+	commands []string
+	fix      func() error
+}
+
+func (runner *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	runner.commands = append(runner.commands, strings.Join(append([]string{name}, args...), " "))
+	if runner.fix == nil {
+		return []byte("device busy"), fmt.Errorf("exit status 1")
+	}
+	return nil, runner.fix()
+}
+
+func (runner *fakeRunner) setFix(fix func() error) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	runner.fix = fix
+}
+
+func (runner *fakeRunner) Commands() []string {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+	return append([]string(nil), runner.commands...)
+}
+
+//limitedStore is a MemoryStore failing to insert once inserts samples are inserted
+type limitedStore struct {
+	*MemoryStore
+	inserts int
+}
+
+func (store *limitedStore) Insert(table string, timestamp int64, data []byte, delivered []string) error {
+	if store.inserts == 0 {
+		return fmt.Errorf("database is locked")
+	}
+	store.inserts--
+	return store.MemoryStore.Insert(table, timestamp, data, delivered)
+}
+
+func TestIsStorageError(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		storage bool
+	}{
+		{fmt.Errorf("open /mnt/data/a.db: read-only file system"), true},
+		{fmt.Errorf("attempt to write a readonly database"), true},
+		{fmt.Errorf("disk I/O error"), true},
+		{fmt.Errorf("write /mnt/data/a.db-wal: input/output error"), true},
+		{fmt.Errorf("no such table: pollutant"), false},
+		{nil, false},
+	} {
+		if isStorageError(test.err) != test.storage {
+			t.Fatalf("Expect storage error %v for %v", test.storage, test.err)
+		}
+	}
+}
+
+func TestRecoverWithFallback(t *testing.T) {
+	handler, local, remote, _ := newTestHandler(t)
+	defer close(handler.done)
+	mainFolder := filepath.Join(t.TempDir(), "sdcard")
+	fallbackFolder := t.TempDir()
+	handler.config.Server.MainFolder = mainFolder
+	handler.config.Server.FallbackFolder = fallbackFolder
+	handler.config.Server.RecoveryDevice = "/dev/sdz1"
+	handler.config.Server.RecoveryCommands = []string{"mount -o remount,rw [Device] [MainFolder]"}
+	handler.config.Server.RecoveryInterval = 3600
+	runner := &fakeRunner{}
+	handler.runner = runner
+	handler.SetStore(&failingStore{MemoryStore: NewMemoryStore(config.DefaultRemoteName), err: fmt.Errorf("attempt to write a readonly database")})
+
+	ts := time.Now().Unix() - 100
+	remote.SetPublishErr(fmt.Errorf("network down"))
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	remote.SetPublishErr(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for !handler.usingFallback() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !handler.usingFallback() {
+		t.Fatal("Expect fallback store used when the main folder is not writable")
+	}
+	if commands := runner.Commands(); len(commands) != 1 || commands[0] != "mount -o remount,rw /dev/sdz1 "+mainFolder {
+		t.Fatalf("Unexpected recovery commands:%v", commands)
+	}
+	local.Deliver(handler.PollutantTopic, pollutantPayload(ts+1))
+	fallback := handler.Store()
+	if records, _ := fallback.Find(Filter{Table: PollutantTable, EndDate: ts + 10}); len(records) != 2 {
+		t.Fatalf("Expect buffered and new samples saved in fallback folder, got %v", records)
+	}
+
+	runner.setFix(func() error {
+		return os.Mkdir(mainFolder, 0755)
+	})
+	if !handler.recoverOnce(time.Now()) || handler.usingFallback() {
+		t.Fatal("Expect main folder used again after it is recovered")
+	}
+	store := handler.Store()
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10}); len(records) != 2 {
+		t.Fatalf("Expect fallback samples merged into main folder, got %v", records)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10, Unsent: config.DefaultRemoteName}); len(records) != 1 || records[0].Timestamp != ts {
+		t.Fatalf("Expect delivery state kept after merging, got %v", records)
+	}
+	if partitions, _ := fallback.Partitions(); len(partitions) != 0 {
+		t.Fatalf("Expect fallback files removed after merging, got %v", partitions)
+	}
+	if sent, err := handler.Remotes[0].pollutantOutbox.Drain(); sent != 1 || err != nil {
+		t.Fatalf("Expect merged unsent sample resent, got %v (%v)", sent, err)
+	}
+}
+
+func TestMergeFallbackAgain(t *testing.T) {
+	handler, _, _, _ := newTestHandler(t)
+	fallback := NewMemoryStore(config.DefaultRemoteName)
+	ts := time.Now().Unix() - 100
+	for i := int64(0); i < 3; i++ {
+		if err := fallback.Insert(PollutantTable, ts+i, pollutantPayload(ts+i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	letter := DeadLetter{Received: ts, Table: RawTable, Topic: "airsence/AUG/AirSENCE-Dummy/raw", Reason: "RawData is missing", Data: []byte{0x80}}
+	if err := fallback.Quarantine(letter); err != nil {
+		t.Fatal(err)
+	}
+	store := &limitedStore{MemoryStore: NewMemoryStore(config.DefaultRemoteName), inserts: 2}
+	handler.mergeFallback(fallback, store)
+	if partitions, _ := fallback.Partitions(); len(partitions) == 0 {
+		t.Fatal("Expect fallback files kept when merging fails")
+	}
+
+	//Merging again with the next recovery only adds the samples and dead letters not merged yet
+	if err := store.Quarantine(letter); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	handler.MainLogger.SetOutput(&output)
+	store.inserts = 10
+	handler.mergeFallback(fallback, store)
+	if !strings.Contains(output.String(), "Merged 1 samples and 0 dead letters") {
+		t.Fatalf("Expect only the samples and dead letters merged counted, got %v", output.String())
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10}); len(records) != 3 {
+		t.Fatalf("Expect every sample merged once, got %v", records)
+	}
+	if letters, _ := store.DeadLetters(0, ts+10, 0); len(letters) != 1 || letters[0].Reason != letter.Reason {
+		t.Fatalf("Expect dead letters merged once, got %+v", letters)
+	}
+	if partitions, _ := fallback.Partitions(); len(partitions) != 0 {
+		t.Fatalf("Expect fallback files removed after merging, got %v", partitions)
+	}
+}
+
+//blockingStore is a MemoryStore whose inserts wait until released, like a sample in flight
+type blockingStore struct {
+	*MemoryStore
+	inserting chan struct{} //inserting receives when an insert starts
+	release   chan struct{}
+}
+
+func (store *blockingStore) Insert(table string, timestamp int64, data []byte, delivered []string) error {
+	store.inserting <- struct{}{}
+	<-store.release
+	return store.MemoryStore.Insert(table, timestamp, data, delivered)
+}
+
+func TestSwitchStoreWaitsForSaves(t *testing.T) {
+	handler, local, _, _ := newTestHandler(t)
+	fallback := &blockingStore{
+		MemoryStore: NewMemoryStore(config.DefaultRemoteName),
+		inserting:   make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	handler.SetStore(fallback)
+	ts := time.Now().Unix() - 100
+	go local.Deliver(handler.PollutantTopic, pollutantPayload(ts))
+	<-fallback.inserting
+
+	switched := make(chan struct{})
+	go func() {
+		handler.switchStore(NewMemoryStore(config.DefaultRemoteName))
+		close(switched)
+	}()
+	select {
+	case <-switched:
+		t.Fatal("Expect the store not switched while a sample is being saved into it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(fallback.release)
+	<-switched
+	if records, _ := fallback.Find(Filter{Table: PollutantTable, EndDate: ts}); len(records) != 1 {
+		t.Fatalf("Expect the sample in flight saved before the switch, got %v", records)
+	}
+}
@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"aws.airsence/datasync/config"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+//Remote is a named remote destination. It has its own transport, topics and outboxes, so the backlog
+//of each destination is resent independently. The connected flag and the topics are guarded by lock
+type Remote struct {
+	lock                 sync.RWMutex
+	Name                 string
+	Type                 string
+	Transport            Transport
+	Qos                  byte
+	WillTopic            string
+	OnlinePayload        string //OnlinePayload is published to WillTopic as retained status on connect
+	RawTopic             string
+	PollutantTopic       string
+	ResendRawTopic       string
+	ResendPollutantTopic string
+	BatchSize            int //BatchSize is the number of rows sent in one request when resending by BatchPublisher
+	limiter              *Limiter
+	connected            bool
+	rawOutbox            *Outbox
+	pollutantOutbox      *Outbox
+	rawResend            sync.Mutex //rawResend is held while raw data is resent, so resends of a table do not overlap
+	pollutantResend      sync.Mutex //pollutantResend is held while pollutant data is resent
+}
+
+//newRemote create the remote destination with the transport, topics with "+" replaced by the client ID
+func newRemote(remoteConfig config.RemoteConfig, clientID string, transport Transport) *Remote {
+	remote := &Remote{
+		Name:      remoteConfig.Name,
+		Type:      remoteConfig.Type,
+		Transport: transport,
+		Qos:       remoteConfig.Qos,
+		BatchSize: remoteConfig.BatchSize,
+		limiter:   NewLimiter(remoteConfig.ResendRate, remoteConfig.ResendByteRate),
+	}
+	remote.setTopics(remoteConfig, clientID)
+	return remote
+}
+
+//setTopics set the topics and online payload of the remote with "+" replaced by the client ID
+func (remote *Remote) setTopics(remoteConfig config.RemoteConfig, clientID string) {
+	remote.lock.Lock()
+	defer remote.lock.Unlock()
+	remote.WillTopic = strings.Replace(remoteConfig.WillTopic, "+", clientID, 1)
+	remote.OnlinePayload = strings.Replace(remoteConfig.OnlinePayload, "+", clientID, 1)
+	remote.RawTopic = strings.Replace(remoteConfig.RawTopic, "+", clientID, 1)
+	remote.PollutantTopic = strings.Replace(remoteConfig.PollutantTopic, "+", clientID, 1)
+	remote.ResendRawTopic = strings.Replace(remoteConfig.ResendRawTopic, "+", clientID, 1)
+	remote.ResendPollutantTopic = strings.Replace(remoteConfig.ResendPollutantTopic, "+", clientID, 1)
+}
+
+//topic return the topic for sending data of the table
+func (remote *Remote) topic(table string) string {
+	remote.lock.RLock()
+	defer remote.lock.RUnlock()
+	if table == RawTable {
+		return remote.RawTopic
+	}
+	return remote.PollutantTopic
+}
+
+//send publish live data of the table to the remote MQTT broker. It takes the tokens of the resend limiter
+//without waiting, so live data takes priority over the backlog
+func (remote *Remote) send(table string, data []byte) error {
+	remote.limiter.Take(len(data))
+	return remote.Transport.Publish(remote.topic(table), remote.Qos, false, data)
+}
+
+//batch return the records to send in one request from the start of the records. It is one record
+//unless the transport is a BatchPublisher and BatchSize is more than 1
+func (remote *Remote) batch(records []Record) []Record {
+	size := 1
+	if _, ok := remote.Transport.(BatchPublisher); ok && remote.BatchSize > 1 {
+		size = remote.BatchSize
+	}
+	if len(records) > size {
+		return records[:size]
+	}
+	return records
+}
+
+//sendRecords send the records to the topic of the remote, in one request when there are more than one
+func (remote *Remote) sendRecords(topic string, records []Record) error {
+	if len(records) == 1 {
+		return remote.Transport.Publish(topic, remote.Qos, false, records[0].Data)
+	}
+	payloads := make([][]byte, len(records))
+	for i, record := range records {
+		payloads[i] = record.Data
+	}
+	return remote.Transport.(BatchPublisher).PublishBatch(topic, remote.Qos, payloads)
+}
+
+//isConnected check whether the remote is connected
+func (remote *Remote) isConnected() bool {
+	remote.lock.RLock()
+	defer remote.lock.RUnlock()
+	return remote.connected
+}
+
+//setConnected set the connected flag of the remote
+func (remote *Remote) setConnected(connected bool) {
+	remote.lock.Lock()
+	defer remote.lock.Unlock()
+	remote.connected = connected
+}
+
+//resendLock return the lock held while the table is resent to the remote
+func (remote *Remote) resendLock(table string) *sync.Mutex {
+	if table == RawTable {
+		return &remote.rawResend
+	}
+	return &remote.pollutantResend
+}
+
+//outbox return the outbox of the table
+func (remote *Remote) outbox(table string) *Outbox {
+	if table == RawTable {
+		return remote.rawOutbox
+	}
+	return remote.pollutantOutbox
+}
+
+//newRemoteTransport create the transport for the remote destination by its type
+func newRemoteTransport(remoteConfig config.RemoteConfig, clientID string, mainLogger *logrus.Logger) (Transport, error) {
+	switch remoteConfig.Type {
+	case config.RemoteTypeMqtt:
+		return NewPahoTransport(newRemoteOptions(remoteConfig, clientID, mainLogger)), nil
+	case config.RemoteTypeHTTP:
+		tlsConfig, err := newTLSConfig(
+			remoteConfig.CAFile,
+			remoteConfig.CertFile,
+			remoteConfig.KeyFile,
+			remoteConfig.ServerName,
+			remoteConfig.InsecureSkipVerify,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("Error when try to get HTTP credential file:%v", err)
+		}
+		if remoteConfig.InsecureSkipVerify {
+			mainLogger.Warnf("TLS certificate verification of remote HTTP endpoint %v is disabled", remoteConfig.Name)
+		}
+		transport, err := NewHTTPTransport(remoteConfig.URL, remoteConfig.Format, remoteConfig.Token, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return transport, nil
+	}
+	return nil, fmt.Errorf("Unknown remote type %v", remoteConfig.Type)
+}
+
+//newRemoteOptions build the paho client options for the remote destination. The client ID of the
+//default destination is <ClientID>_DataSync, others have the destination name appended. The will is retained,
+//so it overwrites the retained online status
+func newRemoteOptions(remoteConfig config.RemoteConfig, clientID string, mainLogger *logrus.Logger) *mqtt.ClientOptions {
+	willPayload := strings.Replace(remoteConfig.WillPayload, "+", clientID, 1)
+	willTopic := strings.Replace(remoteConfig.WillTopic, "+", clientID, 1)
+	tlsRemote, err := newTLSConfig(
+		remoteConfig.CAFile,
+		remoteConfig.CertFile,
+		remoteConfig.KeyFile,
+		remoteConfig.ServerName,
+		remoteConfig.InsecureSkipVerify,
+	)
+	if err != nil {
+		mainLogger.Errorf("Error when try to get MQTT credential file of %v:%v", remoteConfig.Name, err)
+	}
+	if remoteConfig.InsecureSkipVerify {
+		mainLogger.Warnf("TLS certificate verification of remote MQTT broker %v is disabled", remoteConfig.Name)
+	}
+	options := mqtt.NewClientOptions()
+	options.AddBroker(remoteConfig.Servers)
+	if remoteConfig.Name == config.DefaultRemoteName {
+		options.SetClientID(clientID + "_DataSync")
+	} else {
+		options.SetClientID(clientID + "_DataSync_" + remoteConfig.Name)
+	}
+	options.SetUsername(remoteConfig.Username)
+	options.SetPassword(remoteConfig.Password)
+	options.SetWill(willTopic, willPayload, remoteConfig.Qos, true)
+	options.SetKeepAlive(60 * time.Second)
+	options.SetWriteTimeout(5 * time.Second)
+	options.SetPingTimeout(3 * time.Second)
+	options.SetAutoReconnect(false)
+	if tlsRemote != nil {
+		options.SetTLSConfig(tlsRemote)
+	}
+	return options
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+const (
+	retentionInterval    = time.Hour        //retentionInterval is the interval of applying the retention policy
+	maxPurgeReports      = 20               //maxPurgeReports is the number of latest purges reported in status
+	PurgeReasonRetention = "retention"      //PurgeReasonRetention is a partition older than KeepMonths or KeepUnsentMonths
+	PurgeReasonFreeSpace = "low disk space" //PurgeReasonFreeSpace is a partition removed because free space is below MinFreeMB
+	bytesPerMB           = 1 << 20          //bytesPerMB is the number of bytes in a MB
+)
+
+//PurgeReport is a partition removed by the retention policy
+type PurgeReport struct {
+	Time      int64 //Time is the Unix time of the purge
+	Partition string
+	Samples   int //Samples is the number of samples deleted
+	Unsent    int //Unsent is the number of samples deleted before they were sent to every destination
+	Reason    string
+}
+
+//purgeLog keep the latest purge reports. It is safe for concurrent use
+type purgeLog struct {
+	lock    sync.Mutex
+	reports []PurgeReport
+}
+
+//add add the report and drop the oldest ones beyond maxPurgeReports
+func (purges *purgeLog) add(report PurgeReport) {
+	purges.lock.Lock()
+	defer purges.lock.Unlock()
+	purges.reports = append(purges.reports, report)
+	if len(purges.reports) > maxPurgeReports {
+		purges.reports = purges.reports[len(purges.reports)-maxPurgeReports:]
+	}
+}
+
+//latest return a copy of the latest reports, oldest first
+func (purges *purgeLog) latest() []PurgeReport {
+	purges.lock.Lock()
+	defer purges.lock.Unlock()
+	return append([]PurgeReport(nil), purges.reports...)
+}
+
+//runRetention apply the retention policy once the database is ready and then every interval until done is closed
+func (handler *Handler) runRetention(interval time.Duration) {
+	select {
+	case <-handler.done:
+		return
+	case <-handler.DatabaseReady():
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := handler.applyRetention(time.Now()); err != nil {
+			handler.MainLogger.Errorf("Error when apply retention policy:%v", err)
+		}
+		select {
+		case <-handler.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//applyRetention remove the partitions older than KeepMonths, or KeepUnsentMonths for partitions with unsent samples.
+//Then, while free space of the main folder is below MinFreeMB, the oldest partitions are removed, fully sent ones first.
+//The partition of current month and partitions opened for inserting are never removed
+func (handler *Handler) applyRetention(now time.Time) ([]PurgeReport, error) {
+	store := handler.Store()
+	if store == nil {
+		return nil, fmt.Errorf("Database not connected")
+	}
+	server := handler.conf().Server
+	partitions, err := store.Partitions()
+	if err != nil {
+		return nil, err
+	}
+	current := now.UTC().Format("200601")
+	var reports []PurgeReport
+	var sent, unsent []Partition
+	for _, partition := range partitions {
+		if partition.Open || partition.Month >= current {
+			continue
+		}
+		if !retained(partition, server, now) {
+			report, err := handler.removePartition(store, partition, PurgeReasonRetention, now)
+			if err != nil {
+				return reports, err
+			}
+			reports = append(reports, report)
+			continue
+		}
+		if partition.Unsent == 0 {
+			sent = append(sent, partition)
+		} else {
+			unsent = append(unsent, partition)
+		}
+	}
+	if server.MinFreeMB <= 0 {
+		return reports, nil
+	}
+	for _, partition := range append(sent, unsent...) {
+		free, err := diskFree(server.MainFolder)
+		if err != nil {
+			return reports, fmt.Errorf("Unable to get free space of %v:%v", server.MainFolder, err)
+		}
+		if free >= uint64(server.MinFreeMB)*bytesPerMB {
+			break
+		}
+		report, err := handler.removePartition(store, partition, PurgeReasonFreeSpace, now)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+//retained check whether the partition is within KeepMonths months including current month, or KeepUnsentMonths
+//when it has unsent samples and KeepUnsentMonths is more. Every partition is retained when KeepMonths is 0
+func retained(partition Partition, server config.ServerConfig, now time.Time) bool {
+	keep := server.KeepMonths
+	if keep <= 0 {
+		return true
+	}
+	if partition.Unsent > 0 && server.KeepUnsentMonths > keep {
+		keep = server.KeepUnsentMonths
+	}
+	month, err := time.Parse("200601", partition.Month)
+	if err != nil {
+		return true
+	}
+	now = now.UTC()
+	oldest := time.Date(now.Year(), now.Month()-time.Month(keep-1), 1, 0, 0, 0, 0, time.UTC)
+	return !month.Before(oldest)
+}
+
+//removePartition remove the partition from the store, log it and keep the report for status
+func (handler *Handler) removePartition(store Store, partition Partition, reason string, now time.Time) (PurgeReport, error) {
+	count, err := store.RemovePartition(partition.Name)
+	if err != nil {
+		handler.checkStorageError(err)
+		return PurgeReport{}, fmt.Errorf("Error when remove %v:%v", partition.Name, err)
+	}
+	report := PurgeReport{
+		Time:      now.Unix(),
+		Partition: partition.Name,
+		Samples:   count,
+		Unsent:    partition.Unsent,
+		Reason:    reason,
+	}
+	if partition.Unsent > 0 {
+		handler.MainLogger.Warnf("Purged %v (%v) with %v samples, %v of them unsent", partition.Name, reason, count, partition.Unsent)
+	} else {
+		handler.MainLogger.Infof("Purged %v (%v) with %v samples", partition.Name, reason, count)
+	}
+	handler.purges.add(report)
+	return report, nil
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"aws.airsence/datasync/config"
+)
+
+func TestRetention(t *testing.T) {
+	handler, _, _, store := newTestHandler(t)
+	now := time.Date(2022, 6, 15, 0, 0, 0, 0, time.UTC)
+	for _, sample := range []struct {
+		month     time.Month
+		delivered []string
+	}{
+		{time.January, []string{config.DefaultRemoteName}},
+		{time.February, nil},
+		{time.May, []string{config.DefaultRemoteName}},
+		{time.June, nil},
+	} {
+		ts := time.Date(2022, sample.month, 10, 0, 0, 0, 0, time.UTC).Unix()
+		if err := store.Insert(PollutantTable, ts, pollutantPayload(ts), sample.delivered); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler.config.Server.KeepMonths = 3
+	handler.config.Server.KeepUnsentMonths = 6
+	reports, err := handler.applyRetention(now)
+	if err != nil || len(reports) != 1 || reports[0].Partition != "202201" || reports[0].Reason != PurgeReasonRetention {
+		t.Fatalf("Expect sent data of January purged, got %+v (%v)", reports, err)
+	}
+
+	//Free space is always below the threshold, every month but current month is removed, sent ones first
+	handler.config.Server.MinFreeMB = 1 << 30
+	reports, err = handler.applyRetention(now)
+	if err != nil || len(reports) != 2 || reports[0].Partition != "202205" || reports[1].Partition != "202202" {
+		t.Fatalf("Expect May and then February purged for free space, got %+v (%v)", reports, err)
+	}
+	if reports[1].Unsent != 1 || reports[1].Reason != PurgeReasonFreeSpace {
+		t.Fatalf("Unexpected purge report:%+v", reports[1])
+	}
+	if partitions, _ := store.Partitions(); len(partitions) != 1 || partitions[0].Month != "202206" {
+		t.Fatalf("Expect only current month kept, got %+v", partitions)
+	}
+	if purges := handler.status().Purges; len(purges) != 3 || purges[0].Partition != "202201" {
+		t.Fatalf("Expect every purge reported in status, got %+v", purges)
+	}
+}
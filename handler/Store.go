@@ -0,0 +1,1180 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	RawTable       = "raw"       //RawTable is the table for raw data
+	PollutantTable = "pollutant" //PollutantTable is the table for pollutant data
+)
+
+//Store is the storage of the samples received from local MQTT broker. Delivery state is kept for
+//each remote destination, a sample is sent once every destination has received it
+type Store interface {
+	//Insert save a sample into the table with its timestamp and the destinations it was delivered to
+	Insert(table string, timestamp int64, data []byte, delivered []string) error
+	//Find return the samples selected by the filter, ordered by partition, timestamp and ID
+	Find(filter Filter) ([]Record, error)
+	//CountUnsent return the number of samples of the table between startdate and enddate which are not
+	//delivered to the destination
+	CountUnsent(destination string, table string, startdate int64, enddate int64) (int, error)
+	//MarkSent mark the records of the table as delivered to the destination
+	MarkSent(destination string, table string, records []Record) error
+	//Purge delete every sample older than before from every table, whether it is sent or not,
+	//and return the number of samples deleted
+	Purge(before int64) (int, error)
+	//Partitions return every partition of the store in chronological order
+	Partitions() ([]Partition, error)
+	//RemovePartition delete the partition with every sample in it and return the number of samples deleted.
+	//A partition opened for inserting cannot be removed
+	RemovePartition(name string) (int, error)
+	//Quarantine save the message which failed validation with the reason, instead of saving it as a sample
+	Quarantine(letter DeadLetter) error
+	//DeadLetters return at most limit messages quarantined between startdate and enddate in chronological order.
+	//There is no limit when limit <= 0
+	DeadLetters(startdate int64, enddate int64, limit int) ([]DeadLetter, error)
+	//Close release every resource held by the store
+	Close() error
+}
+
+//Record is a sample stored in the Store
+type Record struct {
+	ID        int64
+	Partition string //Partition is where the record is stored, e.g. the monthly database file
+	Timestamp int64
+	Data      []byte
+}
+
+//Partition is the part of the store holding the samples of one month, e.g. the monthly database file
+type Partition struct {
+	Name   string //Name is the same as the Partition of its records
+	Month  string //Month of the samples in 200601 format
+	Size   int64  //Size is the number of bytes used, including the journal files
+	Unsent int    //Unsent is the number of samples not yet sent to every destination
+	Open   bool   //Open is true when the partition is opened for inserting
+}
+
+//Filter select samples of a table for Store.Find
+type Filter struct {
+	Table      string
+	StartDate  int64
+	EndDate    int64
+	Unsent     string   //Unsent only selects samples not delivered to this destination when it is not empty
+	Descending bool     //Descending return the newest samples first
+	After      *Record  //After only selects samples after this record in the order of Find, for reading page by page
+	Keys       []string //Keys only selects samples with any of the keys in their pollutant (or raw) data when it is not empty
+	Limit      int      //Limit is the maximum number of samples, no limit when <= 0
+}
+
+//SQLiteStore is the default Store which saves samples into one SQLite database file per month,
+//named <ClientID>_<YYYYMM>.db in the main folder. The sent column is set once a sample is delivered
+//to every destination, until then the destinations which received it are kept in the delivered table
+type SQLiteStore struct {
+	folder       string
+	clientID     string
+	destinations []string
+	logger       *logrus.Logger
+	lock         sync.RWMutex
+	current      string
+	dbs          map[string]*sql.DB
+	closed       bool            //closed is true once the store is closed, which stops the backfills
+	backfillLock sync.Mutex      //backfillLock guard backfilling
+	backfilling  map[string]bool //backfilling is the paths of the files whose fields are being saved in background
+	backfills    sync.WaitGroup
+}
+
+//dbFile is a monthly database file found in the main folder
+type dbFile struct {
+	Month string
+	Path  string
+}
+
+//clockSynchronized check whether the date is after the milestone date, which means the clock is synchronized
+func clockSynchronized(date time.Time) bool {
+	mileStoneTime, _ := time.Parse(
+		time.RFC3339,
+		DATE,
+	)
+	return !date.Before(mileStoneTime)
+}
+
+//NewSQLiteStore create a SQLiteStore in the folder for the destinations and open the database file of the month of date
+func NewSQLiteStore(
+	folder string,
+	clientID string,
+	destinations []string,
+	logger *logrus.Logger,
+	date time.Time,
+) (*SQLiteStore, error) {
+	store := &SQLiteStore{
+		folder:       folder,
+		clientID:     clientID,
+		destinations: destinations,
+		logger:       logger,
+		dbs:          make(map[string]*sql.DB),
+	}
+	if err := store.Rollover(date); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+//dbPath return the path of the database file for the given month (in 200601 format)
+func (store *SQLiteStore) dbPath(month string) string {
+	return fmt.Sprintf(
+		"%v/%v_%v.db",
+		store.folder,
+		store.clientID,
+		month,
+	)
+}
+
+//dbFiles find every monthly database file in the main folder which covers the time range
+//between startdate and enddate. The files are sorted in chronological order
+func (store *SQLiteStore) dbFiles(startdate int64, enddate int64) ([]dbFile, error) {
+	pattern := filepath.Join(store.folder, store.clientID+"_*.db")
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	prefix := store.clientID + "_"
+	var files []dbFile
+	for _, path := range paths {
+		month := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), prefix), ".db")
+		monthStart, err := time.Parse("200601", month)
+		if err != nil {
+			continue
+		}
+		monthEnd := monthStart.AddDate(0, 1, 0)
+		if monthStart.Unix() > enddate || monthEnd.Unix() <= startdate {
+			continue
+		}
+		files = append(files, dbFile{Month: month, Path: path})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Month < files[j].Month
+	})
+	return files, nil
+}
+
+//openDB open (or create) the database file of the given month, create the tables and migrate them to the latest schema
+func (store *SQLiteStore) openDB(month string) (*sql.DB, error) {
+	dbPath := fmt.Sprintf("%v?cache=shared&mode=rwc&_journal_mode=WAL", store.dbPath(month))
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range []string{PollutantTable, RawTable} {
+		if _, err = db.Exec(fmt.Sprintf(sampleTableStmt, table)); err != nil {
+			store.logger.Errorf("Unable to create %v table:%v", table, err)
+		}
+	}
+	if _, err = db.Exec(deliveredTableStmt); err != nil {
+		store.logger.Errorf("Unable to create delivered table:%v", err)
+	}
+	//Samples could not be inserted into a file of an older schema
+	if err = store.migrate(db, store.dbPath(month)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+//sampleTableStmt create the table of samples with the schema of version 0, which is upgraded by the migrations
+const sampleTableStmt = `
+	create table if not exists %v (id integer not null primary key, ts timestamp,data json,sent bool default false);
+	`
+
+//deliveredTableStmt create the table of destinations which received a sample not yet sent to every destination
+const deliveredTableStmt = `
+	create table if not exists delivered (tbl text not null, id integer not null, destination text not null, primary key(tbl,id,destination));
+	`
+
+//openFile open an existing database file with its own connection in read-write mode, so the file
+//will not be closed by rollover while it is in use. The delivered table is created, but the schema is only
+//migrated when the file is opened for inserting, so files of older versions may lack the tables of later migrations
+func (store *SQLiteStore) openFile(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%v?cache=shared&mode=rw&_journal_mode=WAL", path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(deliveredTableStmt); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+//migrate upgrade the database file to the latest schema version, then save the fields of the samples inserted
+//before migration 2 in background
+func (store *SQLiteStore) migrate(db *sql.DB, path string) error {
+	from, err := migrate(db)
+	if err != nil {
+		return fmt.Errorf("Unable to migrate %v:%v", filepath.Base(path), err)
+	}
+	if from < schemaVersion {
+		store.logger.Infof("Migrated %v from schema version %v to %v", filepath.Base(path), from, schemaVersion)
+	}
+	backfill, err := tableExist(db, "backfill")
+	if err != nil {
+		return fmt.Errorf("Unable to check backfill of %v:%v", filepath.Base(path), err)
+	}
+	if backfill {
+		store.startBackfill(path)
+	}
+	return nil
+}
+
+//allDelivered check whether the sample delivered to the destinations is delivered to every destination of the store
+func allDelivered(destinations []string, delivered []string) bool {
+	for _, destination := range destinations {
+		found := false
+		for _, name := range delivered {
+			if name == destination {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(destinations) > 0 || len(delivered) > 0
+}
+
+//Rollover switch the current database to the file of the month of date. Database files of older months,
+//except the previous month which may still receive late samples, are closed. Since rollover holds the
+//write lock, it waits for in-flight inserts to finish before closing any file. A closed store is not opened again
+func (store *SQLiteStore) Rollover(date time.Time) error {
+	month := date.UTC().Format("200601")
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.closed {
+		return fmt.Errorf("Database closed")
+	}
+	if store.current != "" && month <= store.current {
+		return nil
+	}
+	db, ok := store.dbs[month]
+	if !ok {
+		var err error
+		if db, err = store.openDB(month); err != nil {
+			return err
+		}
+		store.dbs[month] = db
+	}
+	if store.current != "" {
+		store.logger.Infof("Database rollover from %v to %v", store.current, month)
+	}
+	store.current = month
+	previous := date.UTC().AddDate(0, -1, 0).Format("200601")
+	for m, old := range store.dbs {
+		if m == month || m == previous {
+			continue
+		}
+		if err := old.Close(); err != nil {
+			store.logger.Errorf("Unable to close database of %v:%v", m, err)
+		}
+		delete(store.dbs, m)
+	}
+	return nil
+}
+
+//CurrentMonth return the month of current database
+func (store *SQLiteStore) CurrentMonth() string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.current
+}
+
+//monthDB return the database of the month of date with a read lock held, so the database will not be
+//closed by rollover before release is called. Samples with unsynchronized timestamp go to current database
+func (store *SQLiteStore) monthDB(date time.Time) (*sql.DB, func(), error) {
+	month := date.Format("200601")
+	store.lock.RLock()
+	if store.closed {
+		store.lock.RUnlock()
+		return nil, nil, fmt.Errorf("Database closed")
+	}
+	if store.current == "" {
+		store.lock.RUnlock()
+		return nil, nil, fmt.Errorf("Database not connected")
+	}
+	if !clockSynchronized(date) {
+		month = store.current
+	}
+	if db, ok := store.dbs[month]; ok {
+		return db, store.lock.RUnlock, nil
+	}
+	store.lock.RUnlock()
+	//Open the file of an older month for late samples
+	store.lock.Lock()
+	if store.closed {
+		store.lock.Unlock()
+		return nil, nil, fmt.Errorf("Database closed")
+	}
+	if _, ok := store.dbs[month]; !ok {
+		db, err := store.openDB(month)
+		if err != nil {
+			store.lock.Unlock()
+			return nil, nil, err
+		}
+		store.dbs[month] = db
+	}
+	store.lock.Unlock()
+	return store.monthDB(date)
+}
+
+//Insert save the sample into the database file matching the month of its timestamp.
+//A sample newer than current database month means the month has changed
+func (store *SQLiteStore) Insert(table string, timestamp int64, data []byte, delivered []string) error {
+	date := time.Unix(timestamp, 0).UTC()
+	if err := store.rolloverTo(date); err != nil {
+		return err
+	}
+	db, release, err := store.monthDB(date)
+	if err != nil {
+		return err
+	}
+	defer release()
+	sent := allDelivered(store.destinations, delivered)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	sqlStmt := fmt.Sprintf(`
+	insert into %v(ts,data,sent) values (?,?,?)
+	`, table)
+	res, err := tx.Exec(sqlStmt, timestamp, data, sent)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = insertFields(tx, table, id, data); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !sent && len(delivered) > 0 {
+		for _, destination := range delivered {
+			if _, err = tx.Exec(`insert or ignore into delivered(tbl,id,destination) values (?,?,?)`, table, id, destination); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+//rolloverTo rollover to the month of date when it is newer than current database month but not in the future.
+//Nothing can be inserted once the store is closed
+func (store *SQLiteStore) rolloverTo(date time.Time) error {
+	store.lock.RLock()
+	closed, current := store.closed, store.current
+	store.lock.RUnlock()
+	if closed {
+		return fmt.Errorf("Database closed")
+	}
+	month := date.Format("200601")
+	if clockSynchronized(date) &&
+		month > current &&
+		month <= time.Now().UTC().Format("200601") {
+		if err := store.Rollover(date); err != nil {
+			return fmt.Errorf("Unable to rollover database:%v", err)
+		}
+	}
+	return nil
+}
+
+//Quarantine save the message into the deadletter table of the database file matching the month it was received
+func (store *SQLiteStore) Quarantine(letter DeadLetter) error {
+	date := time.Unix(letter.Received, 0).UTC()
+	if err := store.rolloverTo(date); err != nil {
+		return err
+	}
+	db, release, err := store.monthDB(date)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = db.Exec(
+		`insert into deadletter(received,tbl,topic,reason,data) values (?,?,?,?,?)`,
+		letter.Received,
+		letter.Table,
+		letter.Topic,
+		letter.Reason,
+		letter.Data,
+	)
+	return err
+}
+
+//DeadLetters return the messages quarantined in every monthly database file covering the time range in chronological order
+func (store *SQLiteStore) DeadLetters(startdate int64, enddate int64, limit int) ([]DeadLetter, error) {
+	files, err := store.dbFiles(startdate, enddate)
+	if err != nil {
+		return nil, fmt.Errorf("Error when search database files:%v", err)
+	}
+	var letters []DeadLetter
+	for _, file := range files {
+		fileLimit := -1
+		if limit > 0 {
+			if fileLimit = limit - len(letters); fileLimit <= 0 {
+				break
+			}
+		}
+		fileLetters, err := store.deadLettersFile(file.Path, startdate, enddate, fileLimit)
+		if err != nil {
+			return nil, fmt.Errorf("Error when query %v:%v", filepath.Base(file.Path), err)
+		}
+		letters = append(letters, fileLetters...)
+	}
+	return letters, nil
+}
+
+//deadLettersFile return at most limit messages quarantined between startdate and enddate in one database file, -1 means no limit
+func (store *SQLiteStore) deadLettersFile(path string, startdate int64, enddate int64, limit int) ([]DeadLetter, error) {
+	db, err := store.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if exist, err := tableExist(db, "deadletter"); err != nil || !exist {
+		return nil, err
+	}
+	rows, err := db.Query(`
+	select id,received,tbl,topic,reason,data from deadletter where received between ? and ? order by received,id limit ?
+	`, startdate, enddate, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var letters []DeadLetter
+	for rows.Next() {
+		var received time.Time
+		letter := DeadLetter{Partition: filepath.Base(path)}
+		if err = rows.Scan(&letter.ID, &received, &letter.Table, &letter.Topic, &letter.Reason, &letter.Data); err != nil {
+			return nil, err
+		}
+		letter.Received = received.Unix()
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+//Find return the samples selected by the filter from every monthly database file covering the time range.
+//The files are read in chronological order (reversed when descending) and each record is tagged with the name of its file
+func (store *SQLiteStore) Find(filter Filter) ([]Record, error) {
+	files, err := store.dbFiles(filter.StartDate, filter.EndDate)
+	if err != nil {
+		return nil, fmt.Errorf("Error when search database files:%v", err)
+	}
+	if filter.Descending {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+	var records []Record
+	for _, file := range files {
+		fileLimit := -1
+		if filter.Limit > 0 {
+			if fileLimit = filter.Limit - len(records); fileLimit <= 0 {
+				break
+			}
+		}
+		tables := []string{filter.Table}
+		where := []string{`ts between ? and ?`}
+		args := []interface{}{filter.StartDate, filter.EndDate}
+		if filter.Unsent != "" {
+			where = append(where, unsentCondition)
+			args = append(args, filter.Table, filter.Unsent)
+		}
+		if len(filter.Keys) > 0 {
+			tables = append(tables, "sample_values")
+			where = append(where, fmt.Sprintf(
+				`id in (select id from sample_values where tbl = ? and key in (?%v))`,
+				strings.Repeat(",?", len(filter.Keys)-1),
+			))
+			args = append(args, filter.Table)
+			for _, key := range filter.Keys {
+				args = append(args, key)
+			}
+		}
+		if after := filter.After; after != nil {
+			partition := filepath.Base(file.Path)
+			if (!filter.Descending && partition < after.Partition) || (filter.Descending && partition > after.Partition) {
+				continue
+			}
+			if partition == after.Partition {
+				if filter.Descending {
+					where = append(where, `(ts < ? or (ts = ? and id < ?))`)
+				} else {
+					where = append(where, `(ts > ? or (ts = ? and id > ?))`)
+				}
+				args = append(args, after.Timestamp, after.Timestamp, after.ID)
+			}
+		}
+		order := `ts,id`
+		if filter.Descending {
+			order = `ts desc,id desc`
+		}
+		fileRecords, err := store.queryFile(file.Path, tables, strings.Join(where, " and "), order, fileLimit, args...)
+		if err != nil {
+			return nil, fmt.Errorf("Error when query %v:%v", filepath.Base(file.Path), err)
+		}
+		records = append(records, fileRecords...)
+	}
+	return records, nil
+}
+
+//CountUnsent return the number of samples of the table not delivered to the destination in every monthly
+//database file covering the time range
+func (store *SQLiteStore) CountUnsent(destination string, table string, startdate int64, enddate int64) (int, error) {
+	files, err := store.dbFiles(startdate, enddate)
+	if err != nil {
+		return 0, fmt.Errorf("Error when search database files:%v", err)
+	}
+	total := 0
+	for _, file := range files {
+		count, err := store.countFile(file.Path, destination, table, startdate, enddate)
+		if err != nil {
+			return 0, fmt.Errorf("Error when count %v:%v", filepath.Base(file.Path), err)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+//tableExist check whether the table exists in the database, since older files may not have every table
+func tableExist(db *sql.DB, table string) (bool, error) {
+	var exist int
+	err := db.QueryRow(`select count(*) from sqlite_master where type = 'table' and name = ?`, table).Scan(&exist)
+	return exist > 0, err
+}
+
+//unsentCondition is the where clause of samples which are not delivered to a destination.
+//The parameters are the table name and destination
+const unsentCondition = `sent = false
+	and id not in (select id from delivered where tbl = ? and destination = ?)`
+
+//countFile return the number of samples of the table not delivered to the destination in one database file
+func (store *SQLiteStore) countFile(
+	path string,
+	destination string,
+	table string,
+	startdate int64,
+	enddate int64,
+) (int, error) {
+	db, err := store.openFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	if exist, err := tableExist(db, table); err != nil || !exist {
+		return 0, err
+	}
+	countStmt := fmt.Sprintf(`
+	select count(*) from %v where ts between ? and ? and %v
+	`, table, unsentCondition)
+	var count int
+	err = db.QueryRow(countStmt, startdate, enddate, table, destination).Scan(&count)
+	return count, err
+}
+
+//queryFile return at most limit samples of the first table matching the where clause in one database file
+//in the order of the order by clause, -1 means no limit. Nothing matches in a file without every table used
+//by the where clause, e.g. sample_values of a file not migrated yet
+func (store *SQLiteStore) queryFile(
+	path string,
+	tables []string,
+	where string,
+	order string,
+	limit int,
+	args ...interface{},
+) ([]Record, error) {
+	db, err := store.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	for _, table := range tables {
+		if exist, err := tableExist(db, table); err != nil || !exist {
+			return nil, err
+		}
+	}
+	table := tables[0]
+	selectStmt := fmt.Sprintf(`
+	select id,ts,data from %v where %v order by %v limit ?
+	`, table, where, order)
+	rows, err := db.Query(selectStmt, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		var ts time.Time
+		record := Record{Partition: filepath.Base(path)}
+		if err = rows.Scan(&record.ID, &ts, &record.Data); err != nil {
+			return nil, err
+		}
+		record.Timestamp = ts.Unix()
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+//MarkSent mark the records as delivered to the destination in their database files, one transaction for each file
+func (store *SQLiteStore) MarkSent(destination string, table string, records []Record) error {
+	for len(records) > 0 {
+		partition := records[0].Partition
+		end := 1
+		for end < len(records) && records[end].Partition == partition {
+			end++
+		}
+		if err := store.updateFile(filepath.Join(store.folder, partition), destination, table, records[:end]); err != nil {
+			return fmt.Errorf("Error when update %v:%v", partition, err)
+		}
+		records = records[end:]
+	}
+	return nil
+}
+
+//updateFile record the delivery of every record in one transaction. When the record is delivered to every
+//destination, it is marked as sent and its rows in the delivered table are removed
+func (store *SQLiteStore) updateFile(path string, destination string, table string, records []Record) error {
+	db, err := store.openFile(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err = store.deliver(tx, destination, table, record.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//deliver record the delivery of one row to the destination within the transaction
+func (store *SQLiteStore) deliver(tx *sql.Tx, destination string, table string, id int64) error {
+	updateStmt := fmt.Sprintf(`
+	update %v set sent = true where id = ?
+	`, table)
+	if len(store.destinations) <= 1 {
+		_, err := tx.Exec(updateStmt, id)
+		return err
+	}
+	//A row already sent, e.g. replayed with IncludeSent, keeps no delivered rows
+	var sent bool
+	err := tx.QueryRow(fmt.Sprintf(`select sent from %v where id = ?`, table), id).Scan(&sent)
+	if err == sql.ErrNoRows || (err == nil && sent) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`insert or ignore into delivered(tbl,id,destination) values (?,?,?)`, table, id, destination)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`select destination from delivered where tbl = ? and id = ?`, table, id)
+	if err != nil {
+		return err
+	}
+	var delivered []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		delivered = append(delivered, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || !allDelivered(store.destinations, delivered) {
+		return err
+	}
+	if _, err = tx.Exec(updateStmt, id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`delete from delivered where tbl = ? and id = ?`, table, id)
+	return err
+}
+
+//Purge delete samples older than before from every monthly database file. A file of a month which ends before
+//before is removed as a whole unless it is opened for inserting, others have the old rows deleted
+func (store *SQLiteStore) Purge(before int64) (int, error) {
+	files, err := store.dbFiles(0, before)
+	if err != nil {
+		return 0, fmt.Errorf("Error when search database files:%v", err)
+	}
+	total := 0
+	for _, file := range files {
+		monthStart, _ := time.Parse("200601", file.Month)
+		var count int
+		if monthStart.AddDate(0, 1, 0).Unix() <= before {
+			count, err = store.removeOrPurge(file, before)
+		} else {
+			count, err = store.purgeFile(file.Path, before)
+		}
+		if err != nil {
+			return total, fmt.Errorf("Error when purge %v:%v", filepath.Base(file.Path), err)
+		}
+		store.logger.Infof("Purged %v samples from %v", count, filepath.Base(file.Path))
+		total += count
+	}
+	return total, nil
+}
+
+//removeOrPurge remove the database file of a month wholly before the time, or only delete its old samples when it
+//is opened for inserting. The write lock is held like RemovePartition, so a late sample does not open the file while it is removed
+func (store *SQLiteStore) removeOrPurge(file dbFile, before int64) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, opened := store.dbs[file.Month]; opened {
+		return store.purgeFile(file.Path, before)
+	}
+	return store.removeFile(file.Path)
+}
+
+//purgeFile delete samples and dead letters older than before from every table of one database file in one transaction
+func (store *SQLiteStore) purgeFile(path string, before int64) (int, error) {
+	db, err := store.openFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var tables []string
+	for _, table := range []string{RawTable, PollutantTable} {
+		exist, err := tableExist(db, table)
+		if err != nil {
+			return 0, err
+		}
+		if exist {
+			tables = append(tables, table)
+		}
+	}
+	deadletter, err := tableExist(db, "deadletter")
+	if err != nil {
+		return 0, err
+	}
+	//The sample_values table is missing from a file not migrated yet
+	related := []string{"delivered"}
+	values, err := tableExist(db, "sample_values")
+	if err != nil {
+		return 0, err
+	}
+	if values {
+		related = append(related, "sample_values")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if deadletter {
+		if _, err = tx.Exec(`delete from deadletter where received < ?`, before); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	total := 0
+	for _, table := range tables {
+		res, err := tx.Exec(fmt.Sprintf(`delete from %v where ts < ?`, table), before)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		count, _ := res.RowsAffected()
+		total += int(count)
+		for _, name := range related {
+			deleteStmt := fmt.Sprintf(`delete from %v where tbl = ? and id not in (select id from %v)`, name, table)
+			if _, err = tx.Exec(deleteStmt, table); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+	return total, tx.Commit()
+}
+
+//removeFile count the samples of one database file and remove the file with its journal files
+func (store *SQLiteStore) removeFile(path string) (int, error) {
+	db, err := store.openFile(path)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, table := range []string{RawTable, PollutantTable} {
+		exist, err := tableExist(db, table)
+		if err != nil {
+			db.Close()
+			return 0, err
+		}
+		if !exist {
+			continue
+		}
+		var count int
+		if err = db.QueryRow(fmt.Sprintf(`select count(*) from %v`, table)).Scan(&count); err != nil {
+			db.Close()
+			return 0, err
+		}
+		total += count
+	}
+	if err = db.Close(); err != nil {
+		return 0, err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err = os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	return total, os.Remove(path)
+}
+
+//Partitions return every monthly database file in the main folder in chronological order
+func (store *SQLiteStore) Partitions() ([]Partition, error) {
+	files, err := store.dbFiles(0, math.MaxInt64)
+	if err != nil {
+		return nil, fmt.Errorf("Error when search database files:%v", err)
+	}
+	partitions := make([]Partition, 0, len(files))
+	for _, file := range files {
+		partition := Partition{Name: filepath.Base(file.Path), Month: file.Month}
+		store.lock.RLock()
+		_, partition.Open = store.dbs[file.Month]
+		store.lock.RUnlock()
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if info, err := os.Stat(file.Path + suffix); err == nil {
+				partition.Size += info.Size()
+			}
+		}
+		if partition.Unsent, err = store.unsentFile(file.Path); err != nil {
+			return nil, fmt.Errorf("Error when count %v:%v", partition.Name, err)
+		}
+		partitions = append(partitions, partition)
+	}
+	return partitions, nil
+}
+
+//unsentFile return the number of samples of one database file not yet sent to every destination
+func (store *SQLiteStore) unsentFile(path string) (int, error) {
+	db, err := store.openFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	total := 0
+	for _, table := range []string{RawTable, PollutantTable} {
+		exist, err := tableExist(db, table)
+		if err != nil {
+			return 0, err
+		}
+		if !exist {
+			continue
+		}
+		var count int
+		if err = db.QueryRow(fmt.Sprintf(`select count(*) from %v where sent = false`, table)).Scan(&count); err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+//RemovePartition remove the monthly database file unless it is opened for inserting. The write lock is held,
+//so a late sample does not open the file while it is removed
+func (store *SQLiteStore) RemovePartition(name string) (int, error) {
+	files, err := store.dbFiles(0, math.MaxInt64)
+	if err != nil {
+		return 0, fmt.Errorf("Error when search database files:%v", err)
+	}
+	for _, file := range files {
+		if filepath.Base(file.Path) != name {
+			continue
+		}
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		if _, opened := store.dbs[file.Month]; opened {
+			return 0, fmt.Errorf("Database file %v is opened for inserting", name)
+		}
+		return store.removeFile(file.Path)
+	}
+	return 0, fmt.Errorf("Database file %v not found", name)
+}
+
+//Close close every opened database file
+func (store *SQLiteStore) Close() error {
+	store.lock.Lock()
+	store.closed = true
+	store.lock.Unlock()
+	store.backfills.Wait()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var lastErr error
+	for month, db := range store.dbs {
+		if err := db.Close(); err != nil {
+			store.logger.Errorf("Unable to close connection with database of %v:%v", month, err)
+			lastErr = err
+		}
+		delete(store.dbs, month)
+	}
+	store.current = ""
+	return lastErr
+}
+
+//MemoryStore is a Store which keeps samples in memory. Records are partitioned by month like SQLiteStore.
+//It is used for testing the handler without SD card
+type MemoryStore struct {
+	lock         sync.Mutex
+	nextID       int64
+	destinations []string
+	records      map[string][]memoryRecord
+	deadLetters  []DeadLetter
+}
+
+type memoryRecord struct {
+	Record
+	sent      bool
+	delivered []string
+}
+
+//NewMemoryStore create an empty MemoryStore for the destinations
+func NewMemoryStore(destinations ...string) *MemoryStore {
+	return &MemoryStore{
+		destinations: destinations,
+		records:      make(map[string][]memoryRecord),
+	}
+}
+
+//Insert save the sample in memory
+func (store *MemoryStore) Insert(table string, timestamp int64, data []byte, delivered []string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.nextID++
+	record := Record{
+		ID:        store.nextID,
+		Partition: time.Unix(timestamp, 0).UTC().Format("200601"),
+		Timestamp: timestamp,
+		Data:      append([]byte(nil), data...),
+	}
+	store.records[table] = append(store.records[table], memoryRecord{
+		Record:    record,
+		sent:      allDelivered(store.destinations, delivered),
+		delivered: append([]string(nil), delivered...),
+	})
+	return nil
+}
+
+//isDelivered check whether the record is delivered to the destination
+func (record memoryRecord) isDelivered(destination string) bool {
+	if record.sent {
+		return true
+	}
+	for _, name := range record.delivered {
+		if name == destination {
+			return true
+		}
+	}
+	return false
+}
+
+//Find return the samples selected by the filter ordered by partition, timestamp and ID
+func (store *MemoryStore) Find(filter Filter) ([]Record, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var records []Record
+	for _, record := range store.records[filter.Table] {
+		if record.Timestamp < filter.StartDate || record.Timestamp > filter.EndDate {
+			continue
+		}
+		if filter.Unsent != "" && record.isDelivered(filter.Unsent) {
+			continue
+		}
+		if len(filter.Keys) > 0 && !hasKeys(filter.Table, record.Data, filter.Keys) {
+			continue
+		}
+		if after := filter.After; after != nil {
+			if (!filter.Descending && !recordLess(*after, record.Record)) || (filter.Descending && !recordLess(record.Record, *after)) {
+				continue
+			}
+		}
+		records = append(records, record.Record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if filter.Descending {
+			return recordLess(records[j], records[i])
+		}
+		return recordLess(records[i], records[j])
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+//recordLess compare the records by partition, timestamp and ID
+func recordLess(a Record, b Record) bool {
+	if a.Partition != b.Partition {
+		return a.Partition < b.Partition
+	}
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
+
+//CountUnsent return the number of samples of the table between startdate and enddate not delivered to the destination
+func (store *MemoryStore) CountUnsent(destination string, table string, startdate int64, enddate int64) (int, error) {
+	records, err := store.Find(Filter{Table: table, StartDate: startdate, EndDate: enddate, Unsent: destination})
+	return len(records), err
+}
+
+//MarkSent mark the records of the table as delivered to the destination
+func (store *MemoryStore) MarkSent(destination string, table string, records []Record) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	ids := make(map[int64]bool)
+	for _, record := range records {
+		ids[record.ID] = true
+	}
+	for i := range store.records[table] {
+		record := &store.records[table][i]
+		if !ids[record.ID] || record.isDelivered(destination) {
+			continue
+		}
+		record.delivered = append(record.delivered, destination)
+		if len(store.destinations) <= 1 || allDelivered(store.destinations, record.delivered) {
+			record.sent = true
+		}
+	}
+	return nil
+}
+
+//Purge delete every sample older than before
+func (store *MemoryStore) Purge(before int64) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	total := 0
+	for table, records := range store.records {
+		var kept []memoryRecord
+		for _, record := range records {
+			if record.Timestamp < before {
+				total++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		store.records[table] = kept
+	}
+	var letters []DeadLetter
+	for _, letter := range store.deadLetters {
+		if letter.Received >= before {
+			letters = append(letters, letter)
+		}
+	}
+	store.deadLetters = letters
+	return total, nil
+}
+
+//Quarantine keep the message in memory, partitioned by the month it was received
+func (store *MemoryStore) Quarantine(letter DeadLetter) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.nextID++
+	letter.ID = store.nextID
+	letter.Partition = time.Unix(letter.Received, 0).UTC().Format("200601")
+	letter.Data = append([]byte(nil), letter.Data...)
+	store.deadLetters = append(store.deadLetters, letter)
+	return nil
+}
+
+//DeadLetters return at most limit messages quarantined between startdate and enddate in the order they were received
+func (store *MemoryStore) DeadLetters(startdate int64, enddate int64, limit int) ([]DeadLetter, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	var letters []DeadLetter
+	for _, letter := range store.deadLetters {
+		if limit > 0 && len(letters) >= limit {
+			break
+		}
+		if letter.Received >= startdate && letter.Received <= enddate {
+			letters = append(letters, letter)
+		}
+	}
+	return letters, nil
+}
+
+//Partitions return the samples in memory grouped by month
+func (store *MemoryStore) Partitions() ([]Partition, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	partitions := make(map[string]*Partition)
+	var names []string
+	for _, records := range store.records {
+		for _, record := range records {
+			partition, ok := partitions[record.Partition]
+			if !ok {
+				partition = &Partition{Name: record.Partition, Month: record.Partition}
+				partitions[record.Partition] = partition
+				names = append(names, record.Partition)
+			}
+			partition.Size += int64(len(record.Data))
+			if !record.sent {
+				partition.Unsent++
+			}
+		}
+	}
+	sort.Strings(names)
+	sorted := make([]Partition, len(names))
+	for i, name := range names {
+		sorted[i] = *partitions[name]
+	}
+	return sorted, nil
+}
+
+//RemovePartition delete every sample of the month
+func (store *MemoryStore) RemovePartition(name string) (int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	total := 0
+	for table, records := range store.records {
+		var kept []memoryRecord
+		for _, record := range records {
+			if record.Partition == name {
+				total++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		store.records[table] = kept
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("Partition %v not found", name)
+	}
+	return total, nil
+}
+
+//Close does nothing for MemoryStore
+func (store *MemoryStore) Close() error {
+	return nil
+}
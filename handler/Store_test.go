@@ -0,0 +1,315 @@
+package handler
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logger
+}
+
+func TestDBFiles(t *testing.T) {
+	folder := t.TempDir()
+	for _, name := range []string{
+		"AirSENCE-Dummy_202104.db",
+		"AirSENCE-Dummy_202102.db",
+		"AirSENCE-Dummy_202103.db",
+		"AirSENCE-Other_202103.db",
+		"AirSENCE-Dummy_backup.db",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(folder, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := &SQLiteStore{folder: folder, clientID: "AirSENCE-Dummy"}
+	startdate := time.Date(2021, 2, 15, 0, 0, 0, 0, time.UTC).Unix()
+	enddate := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC).Unix()
+	files, err := store.dbFiles(startdate, enddate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Month != "202102" || files[1].Month != "202103" {
+		t.Fatalf("Unexpected database files:%v", files)
+	}
+	files, err = store.dbFiles(0, time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expect 3 database files, got %v", files)
+	}
+}
+
+func TestSQLiteStoreRollover(t *testing.T) {
+	store, err := NewSQLiteStore(t.TempDir(), "AirSENCE-Dummy", []string{"cloud"}, testLogger(), time.Date(2022, 3, 28, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	samples := []int64{
+		time.Date(2022, 3, 31, 23, 59, 0, 0, time.UTC).Unix(),
+		time.Date(2022, 4, 1, 0, 1, 0, 0, time.UTC).Unix(),
+		time.Date(2022, 3, 31, 23, 59, 30, 0, time.UTC).Unix(),
+	}
+	for _, ts := range samples {
+		if err := store.Insert(PollutantTable, ts, []byte{0x80}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.CurrentMonth() != "202204" {
+		t.Fatalf("Expect rollover to 202204, got %v", store.CurrentMonth())
+	}
+	for month, expected := range map[string]int{"202203": 2, "202204": 1} {
+		db, err := sql.Open("sqlite3", store.dbPath(month))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		if err = db.QueryRow("select count(*) from pollutant").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if count != expected {
+			t.Fatalf("Expect %v rows in %v, got %v", expected, month, count)
+		}
+	}
+
+	//A closed store is not opened again by a later sample
+	store.Close()
+	if err := store.Rollover(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)); err == nil || len(store.dbs) != 0 {
+		t.Fatalf("Expect rollover of closed store to fail without opening files, got %v (%v)", store.dbs, err)
+	}
+}
+
+func TestSQLiteStoreClosed(t *testing.T) {
+	folder := t.TempDir()
+	now := time.Now().UTC()
+	store, err := NewSQLiteStore(folder, "AirSENCE-Dummy", []string{"cloud"}, testLogger(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Insert(PollutantTable, now.Unix(), []byte{0x80}, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	if err = store.Insert(PollutantTable, now.Unix(), []byte{0x80}, nil); err == nil || err.Error() != "Database closed" {
+		t.Fatalf("Expect insert after close to fail, got %v", err)
+	}
+	if err = store.Quarantine(DeadLetter{Received: now.Unix(), Table: RawTable}); err == nil || err.Error() != "Database closed" {
+		t.Fatalf("Expect quarantine after close to fail, got %v", err)
+	}
+	if len(store.dbs) != 0 || store.CurrentMonth() != "" {
+		t.Fatalf("Expect no database file opened after close, got %v", store.dbs)
+	}
+	if count, err := store.RemovePartition(filepath.Base(store.dbPath(now.Format("200601")))); err != nil || count != 1 {
+		t.Fatalf("Expect the partition of the closed store removed, got %v (%v)", count, err)
+	}
+}
+
+func TestSQLiteStorePurge(t *testing.T) {
+	folder := t.TempDir()
+	store, err := NewSQLiteStore(folder, "AirSENCE-Dummy", []string{"cloud"}, testLogger(), time.Date(2022, 1, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	january := time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC).Unix()
+	april := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	for _, ts := range []int64{january, january + 60, april} {
+		if err = store.Insert(RawTable, ts, []byte{0x80}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := store.Purge(time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC).Unix()); err != nil || count != 2 {
+		t.Fatalf("Expect 2 records purged, got %v (%v)", count, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(folder, "AirSENCE-Dummy_202201.db*")); len(files) != 0 {
+		t.Fatalf("Expect database file of closed month removed, got %v", files)
+	}
+	if all, err := store.Find(Filter{Table: RawTable, EndDate: april}); err != nil || len(all) != 1 {
+		t.Fatalf("Expect the record of april kept, got %v (%v)", all, err)
+	}
+}
+
+func TestSQLiteStorePartitions(t *testing.T) {
+	folder := t.TempDir()
+	store, err := NewSQLiteStore(folder, "AirSENCE-Dummy", []string{"cloud"}, testLogger(), time.Date(2022, 4, 10, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	january := time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC).Unix()
+	april := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	for _, ts := range []int64{january, january + 60, april} {
+		if err = store.Insert(RawTable, ts, []byte{0x80}, []string{"cloud"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.Insert(PollutantTable, january, []byte{0x80}, nil); err != nil {
+		t.Fatal(err)
+	}
+	partitions, err := store.Partitions()
+	if err != nil || len(partitions) != 2 {
+		t.Fatalf("Expect 2 partitions, got %+v (%v)", partitions, err)
+	}
+	if partitions[0].Name != "AirSENCE-Dummy_202201.db" || partitions[0].Unsent != 1 || partitions[0].Size == 0 || !partitions[1].Open {
+		t.Fatalf("Unexpected partitions:%+v", partitions)
+	}
+	if _, err = store.RemovePartition(partitions[1].Name); err == nil {
+		t.Fatal("Expect partition opened for inserting not removed")
+	}
+	//January is opened by the late samples, it is closed by the rollover of next month
+	if err = store.Rollover(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := store.RemovePartition(partitions[0].Name); err != nil || count != 3 {
+		t.Fatalf("Expect 3 samples removed, got %v (%v)", count, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(folder, "AirSENCE-Dummy_202201.db*")); len(files) != 0 {
+		t.Fatalf("Expect database file removed, got %v", files)
+	}
+}
+
+//testStore run the same checks against every Store implementation with the only destination "cloud"
+func testStore(t *testing.T, store Store) {
+	march := time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC).Unix()
+	april := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	inserts := []struct {
+		ts        int64
+		delivered []string
+	}{{april, nil}, {march, nil}, {march + 60, []string{"cloud"}}, {april + 60, nil}}
+	for _, insert := range inserts {
+		if err := store.Insert(PollutantTable, insert.ts, []byte{byte(insert.ts % 256)}, insert.delivered); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := store.Find(Filter{Table: PollutantTable, EndDate: april + 3600, Unsent: "cloud"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0].Timestamp != march || records[2].Timestamp != april+60 {
+		t.Fatalf("Unexpected unsent records:%v", records)
+	}
+	if records[0].Partition == records[1].Partition {
+		t.Fatalf("Expect records of different months in different partitions:%v", records)
+	}
+	if limited, _ := store.Find(Filter{Table: PollutantTable, EndDate: april + 3600, Unsent: "cloud", Limit: 2}); len(limited) != 2 || limited[1].Timestamp != april {
+		t.Fatalf("Unexpected limited unsent records:%v", limited)
+	}
+	if count, err := store.CountUnsent("cloud", PollutantTable, march, april); err != nil || count != 2 {
+		t.Fatalf("Expect 2 unsent records between march and april, got %v (%v)", count, err)
+	}
+	if err = store.MarkSent("cloud", PollutantTable, records[:2]); err != nil {
+		t.Fatal(err)
+	}
+	records, err = store.Find(Filter{Table: PollutantTable, EndDate: april + 3600, Unsent: "cloud"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Timestamp != april+60 {
+		t.Fatalf("Unexpected unsent records after mark sent:%v", records)
+	}
+	if all, err := store.Find(Filter{Table: PollutantTable, StartDate: march, EndDate: april}); err != nil || len(all) != 3 || all[1].Timestamp != march+60 {
+		t.Fatalf("Expect 3 records between march and april whether sent or not, got %v (%v)", all, err)
+	}
+	records, err = store.Find(Filter{Table: RawTable, EndDate: april + 3600, Unsent: "cloud"})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("Expect no raw records, got %v (%v)", records, err)
+	}
+	newest, err := store.Find(Filter{Table: PollutantTable, StartDate: 0, EndDate: april + 3600, Descending: true, Limit: 2})
+	if err != nil || len(newest) != 2 || newest[0].Timestamp != april+60 || newest[1].Timestamp != april {
+		t.Fatalf("Expect newest records first, got %v (%v)", newest, err)
+	}
+	next, err := store.Find(Filter{Table: PollutantTable, StartDate: 0, EndDate: april + 3600, Descending: true, After: &newest[1]})
+	if err != nil || len(next) != 2 || next[0].Timestamp != march+60 || next[1].Timestamp != march {
+		t.Fatalf("Expect the records after the cursor, got %v (%v)", next, err)
+	}
+	if count, err := store.Purge(march + 30); err != nil || count != 1 {
+		t.Fatalf("Expect 1 record purged, got %v (%v)", count, err)
+	}
+	if all, err := store.Find(Filter{Table: PollutantTable, EndDate: april + 3600}); err != nil || len(all) != 3 || all[0].Timestamp != march+60 {
+		t.Fatalf("Unexpected records after purge:%v (%v)", all, err)
+	}
+}
+
+//testDestinations check the delivery state is kept for each destination of the store with destinations "cloud" and "customer"
+func testDestinations(t *testing.T, store Store) {
+	ts := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	for i, delivered := range [][]string{nil, {"cloud"}, {"customer"}, {"cloud", "customer"}} {
+		if err := store.Insert(PollutantTable, ts+int64(i), []byte{byte(i)}, delivered); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for destination, expected := range map[string][]int64{"cloud": {ts, ts + 2}, "customer": {ts, ts + 1}} {
+		records, err := store.Find(Filter{Table: PollutantTable, StartDate: ts, EndDate: ts + 10, Unsent: destination})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != len(expected) || records[0].Timestamp != expected[0] || records[1].Timestamp != expected[1] {
+			t.Fatalf("Unexpected records unsent to %v:%v", destination, records)
+		}
+	}
+	records, _ := store.Find(Filter{Table: PollutantTable, StartDate: ts, EndDate: ts + 10, Unsent: "cloud"})
+	if err := store.MarkSent("cloud", PollutantTable, records); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := store.CountUnsent("cloud", PollutantTable, ts, ts+10); err != nil || count != 0 {
+		t.Fatalf("Expect every record delivered to cloud, got %v (%v)", count, err)
+	}
+	if count, err := store.CountUnsent("customer", PollutantTable, ts, ts+10); err != nil || count != 2 {
+		t.Fatalf("Expect 2 records unsent to customer, got %v (%v)", count, err)
+	}
+	records, _ = store.Find(Filter{Table: PollutantTable, StartDate: ts, EndDate: ts + 10, Unsent: "customer"})
+	if err := store.MarkSent("customer", PollutantTable, records); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := store.CountUnsent("customer", PollutantTable, ts, ts+10); err != nil || count != 0 {
+		t.Fatalf("Expect every record delivered to customer, got %v (%v)", count, err)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := NewSQLiteStore(t.TempDir(), "AirSENCE-Dummy", []string{"cloud"}, testLogger(), time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore("cloud"))
+}
+
+func TestSQLiteStoreDestinations(t *testing.T) {
+	folder := t.TempDir()
+	store, err := NewSQLiteStore(folder, "AirSENCE-Dummy", []string{"cloud", "customer"}, testLogger(), time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testDestinations(t, store)
+	db, err := sql.Open("sqlite3", store.dbPath("202204"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var sent, delivered int
+	db.QueryRow("select count(*) from pollutant where sent = true").Scan(&sent)
+	db.QueryRow("select count(*) from delivered").Scan(&delivered)
+	if sent != 4 || delivered != 0 {
+		t.Fatalf("Expect every row sent without delivered rows left, got %v sent and %v delivered", sent, delivered)
+	}
+}
+
+func TestMemoryStoreDestinations(t *testing.T) {
+	testDestinations(t, NewMemoryStore("cloud", "customer"))
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+//Message is a message received from a subscribed topic
+type Message interface {
+	Topic() string
+	Payload() []byte
+}
+
+//MessageHandler is the callback for a subscribed topic. It gets the transport which the message arrived on.
+//Messages of a transport are delivered one by one in order, so the callback should not block, e.g. on rate limits
+type MessageHandler func(transport Transport, msg Message)
+
+//Publisher publish messages to a broker
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+}
+
+//Subscriber subscribe to topics of a broker
+type Subscriber interface {
+	Subscribe(topic string, qos byte, callback MessageHandler) error
+}
+
+//Transport is the connection to a MQTT broker which Handler depends on
+type Transport interface {
+	Publisher
+	Subscriber
+	//SetConnectionHandlers set the callbacks for connection established and connection lost.
+	//It should be called before Connect
+	SetConnectionHandlers(onConnect func(Transport), onLost func(Transport, error))
+	//Connect connect to the broker and block until it is done
+	Connect() error
+	//Disconnect close the connection with the broker
+	Disconnect()
+}
+
+//PahoTransport is the Transport built on paho MQTT client
+type PahoTransport struct {
+	client    mqtt.Client
+	onConnect func(Transport)
+	onLost    func(Transport, error)
+}
+
+//NewPahoTransport create a PahoTransport with the client options. The connection handlers of
+//the options are replaced by the ones set with SetConnectionHandlers
+func NewPahoTransport(options *mqtt.ClientOptions) *PahoTransport {
+	transport := &PahoTransport{}
+	options.SetOnConnectHandler(func(c mqtt.Client) {
+		if transport.onConnect != nil {
+			transport.onConnect(transport)
+		}
+	})
+	options.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		if transport.onLost != nil {
+			transport.onLost(transport, err)
+		}
+	})
+	transport.client = mqtt.NewClient(options)
+	return transport
+}
+
+//SetConnectionHandlers set the callbacks for connection established and connection lost
+func (transport *PahoTransport) SetConnectionHandlers(onConnect func(Transport), onLost func(Transport, error)) {
+	transport.onConnect = onConnect
+	transport.onLost = onLost
+}
+
+//Connect connect to the broker
+func (transport *PahoTransport) Connect() error {
+	return waitToken(transport.client.Connect())
+}
+
+//Disconnect close the connection with the broker
+func (transport *PahoTransport) Disconnect() {
+	transport.client.Disconnect(250)
+}
+
+//Publish publish the payload to the topic and wait until it is done
+func (transport *PahoTransport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return waitToken(transport.client.Publish(topic, qos, retained, payload))
+}
+
+//Subscribe subscribe to the topic and wait until it is done
+func (transport *PahoTransport) Subscribe(topic string, qos byte, callback MessageHandler) error {
+	token := transport.client.Subscribe(topic, qos, func(c mqtt.Client, msg mqtt.Message) {
+		callback(transport, msg)
+	})
+	return waitToken(token)
+}
+
+//waitToken wait for the MQTT token to complete and return its error
+func waitToken(token mqtt.Token) error {
+	for !token.WaitTimeout(5 * time.Second) {
+	}
+	return token.Error()
+}
+
+//newTLSConfig build the TLS config with the CA bundle, client certificate/key pair, server name override
+//and insecure skip verify flag. It returns nil when none of them is configured
+func newTLSConfig(
+	caFile string,
+	certFile string,
+	keyFile string,
+	serverName string,
+	insecureSkipVerify bool,
+) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA file:%v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No certificate found in CA file %v", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate:%v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cer}
+	}
+	return tlsConfig, nil
+}
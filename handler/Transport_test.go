@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeMessage is a Message delivered by fakeTransport
+type fakeMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (msg fakeMessage) Topic() string   { return msg.topic }
+func (msg fakeMessage) Payload() []byte { return msg.payload }
+
+//fakeTransport is an in-process Transport. Published messages are recorded and messages can be
+//delivered to the subscribed topics with Deliver
+type fakeTransport struct {
+	lock          sync.Mutex
+	connected     bool
+	publishErr    error
+	failAfter     int //failAfter is the number of publishes to succeed before failing once with failOnceErr
+	failOnceErr   error
+	connectErr    error
+	published     []fakeMessage
+	subscriptions map[string]MessageHandler
+	onConnect     func(Transport)
+	onLost        func(Transport, error)
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{subscriptions: make(map[string]MessageHandler)}
+}
+
+func (transport *fakeTransport) SetConnectionHandlers(onConnect func(Transport), onLost func(Transport, error)) {
+	transport.onConnect = onConnect
+	transport.onLost = onLost
+}
+
+func (transport *fakeTransport) Connect() error {
+	transport.lock.Lock()
+	err := transport.connectErr
+	transport.connected = err == nil
+	transport.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if transport.onConnect != nil {
+		transport.onConnect(transport)
+	}
+	return nil
+}
+
+func (transport *fakeTransport) Disconnect() {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.connected = false
+}
+
+//Lose simulate a lost connection, the connection lost handler may reconnect
+func (transport *fakeTransport) Lose(err error) {
+	transport.Disconnect()
+	if transport.onLost != nil {
+		transport.onLost(transport, err)
+	}
+}
+
+func (transport *fakeTransport) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if !transport.connected {
+		return fmt.Errorf("not connected")
+	}
+	if transport.publishErr != nil {
+		return transport.publishErr
+	}
+	if transport.failOnceErr != nil {
+		if transport.failAfter == 0 {
+			err := transport.failOnceErr
+			transport.failOnceErr = nil
+			return err
+		}
+		transport.failAfter--
+	}
+	transport.published = append(transport.published, fakeMessage{topic: topic, payload: payload, retained: retained})
+	return nil
+}
+
+func (transport *fakeTransport) Subscribe(topic string, qos byte, callback MessageHandler) error {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.subscriptions[topic] = callback
+	return nil
+}
+
+//SetPublishErr make every following publish fail with err (or succeed when err is nil)
+func (transport *fakeTransport) SetPublishErr(err error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.publishErr = err
+}
+
+//FailOnceAfter clear the publish error, let n publishes succeed and then fail the next one with err
+func (transport *fakeTransport) FailOnceAfter(n int, err error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	transport.publishErr = nil
+	transport.failAfter = n
+	transport.failOnceErr = err
+}
+
+//Deliver deliver the payload to the callback subscribed to the topic
+func (transport *fakeTransport) Deliver(topic string, payload []byte) {
+	transport.lock.Lock()
+	callback, ok := transport.subscriptions[topic]
+	transport.lock.Unlock()
+	if ok {
+		callback(transport, fakeMessage{topic: topic, payload: payload})
+	}
+}
+
+//Published return the messages published to topics with the prefix
+func (transport *fakeTransport) Published(prefix string) []fakeMessage {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	var messages []fakeMessage
+	for _, msg := range transport.published {
+		if strings.HasPrefix(msg.topic, prefix) {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if tlsConfig, err := newTLSConfig("", "", "", "", false); tlsConfig != nil || err != nil {
+		t.Fatalf("Expect no TLS config when nothing configured, got %v (%v)", tlsConfig, err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Private CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := newTLSConfig(caFile, "", "", "broker.example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.RootCAs == nil || tlsConfig.ServerName != "broker.example.com" || tlsConfig.InsecureSkipVerify {
+		t.Fatalf("Unexpected TLS config:%+v", tlsConfig)
+	}
+	if _, err = newTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), "", "", "", false); err == nil {
+		t.Fatal("Expect error for missing CA file")
+	}
+	if tlsConfig, err = newTLSConfig("", "", "", "", true); err != nil || !tlsConfig.InsecureSkipVerify {
+		t.Fatalf("Expect insecure TLS config, got %v (%v)", tlsConfig, err)
+	}
+}
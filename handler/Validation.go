@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+//maxFutureSkew is how far the timestamp of a sample may be ahead of the clock of the device
+const maxFutureSkew = time.Hour
+
+//DeadLetter is a message from local MQTT broker quarantined because it is malformed or invalid,
+//which is neither sent nor saved as a sample
+type DeadLetter struct {
+	ID        int64
+	Partition string //Partition is where the message is stored, e.g. the monthly database file
+	Received  int64  //Received is the Unix time the message was received
+	Table     string
+	Topic     string
+	Reason    string
+	Data      []byte //Data is the message as received
+}
+
+//validateSample decode the msgpack sample of the table and check the required fields, the timestamp, the device
+//ID and the values. It returns the timestamp of the sample, or the reason why the sample is invalid
+func validateSample(table string, data []byte, clientID string, now time.Time) (int64, error) {
+	var sample sampleFields
+	if err := msgpack.Unmarshal(data, &sample); err != nil {
+		return 0, fmt.Errorf("Unable to decode msgpack:%v", err)
+	}
+	values, name := sample.PollutantData, "PollutantData"
+	if table == RawTable {
+		values, name = sample.RawData, "RawData"
+	}
+	switch {
+	case sample.DeviceID == "":
+		return 0, fmt.Errorf("DeviceID is missing")
+	case sample.DeviceID != clientID:
+		return 0, fmt.Errorf("DeviceID %v does not match ClientID %v", sample.DeviceID, clientID)
+	case sample.Timestamp <= 0:
+		return 0, fmt.Errorf("Timestamp is missing")
+	case clockSynchronized(now) && sample.Timestamp > now.Add(maxFutureSkew).Unix():
+		return 0, fmt.Errorf("Timestamp %v is in the future", time.Unix(sample.Timestamp, 0).UTC().Format(time.RFC3339))
+	case len(values) == 0:
+		return 0, fmt.Errorf("%v is missing", name)
+	}
+	for key, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, fmt.Errorf("%v %v is not a finite number", name, key)
+		}
+	}
+	for key, value := range sample.GPS {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, fmt.Errorf("GPS %v is not a finite number", key)
+		}
+	}
+	return sample.Timestamp, nil
+}
+
+//quarantine save the invalid message of the table into the dead letters of the store instead of sending
+//or saving it as a sample. It is buffered in memory like samples while the database is not ready
+func (handler *Handler) quarantine(table string, msg Message, reason error) {
+	handler.Metrics.Quarantined(table)
+	handler.MainLogger.Warnf("Quarantined %v message from %v:%v", table, msg.Topic(), reason)
+	letter := DeadLetter{
+		Received: time.Now().Unix(),
+		Table:    table,
+		Topic:    msg.Topic(),
+		Reason:   reason.Error(),
+		Data:     msg.Payload(),
+	}
+	if err := handler.save(pendingSample{table: table, timestamp: letter.Received, letter: &letter}); err != nil {
+		handler.MainLogger.Errorf("Unable to save quarantined %v message:%v", table, err)
+	}
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestValidateSample(t *testing.T) {
+	now := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC)
+	ts := now.Unix() - 60
+	values := map[string]float64{"NO2": 2.5}
+	for _, test := range []struct {
+		name   string
+		sample PollutantDataMsgPack
+		valid  bool
+	}{
+		{"valid", PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts, PollutantData: values}, true},
+		{"missing device ID", PollutantDataMsgPack{Timestamp: ts, PollutantData: values}, false},
+		{"other device", PollutantDataMsgPack{DeviceID: "AirSENCE-Other", Timestamp: ts, PollutantData: values}, false},
+		{"zero timestamp", PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", PollutantData: values}, false},
+		{"future timestamp", PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: now.Unix() + 7200, PollutantData: values}, false},
+		{"missing values", PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts}, false},
+		{"NaN value", PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts, PollutantData: map[string]float64{"NO2": math.NaN()}}, false},
+		{"infinite GPS", PollutantDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts, GPS: map[string]float64{"Latitude": math.Inf(1)}, PollutantData: values}, false},
+	} {
+		data, _ := msgpack.Marshal(test.sample)
+		timestamp, err := validateSample(PollutantTable, data, "AirSENCE-Dummy", now)
+		if (err == nil) != test.valid || (test.valid && timestamp != ts) {
+			t.Fatalf("Expect %v sample valid %v, got %v (%v)", test.name, test.valid, timestamp, err)
+		}
+	}
+	if _, err := validateSample(RawTable, []byte{0xc1}, "AirSENCE-Dummy", now); err == nil {
+		t.Fatal("Expect malformed msgpack invalid")
+	}
+	//The future is unknown before the clock is synchronized
+	data, _ := msgpack.Marshal(RawDataMsgPack{DeviceID: "AirSENCE-Dummy", Timestamp: ts, RawData: values})
+	if _, err := validateSample(RawTable, data, "AirSENCE-Dummy", time.Unix(0, 0)); err != nil {
+		t.Fatalf("Expect sample valid before the clock is synchronized, got %v", err)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	ts := time.Now().Unix() - 100
+	other, _ := msgpack.Marshal(PollutantDataMsgPack{DeviceID: "AirSENCE-Other", Timestamp: ts, PollutantData: map[string]float64{"NO2": 2.5}})
+	local.Deliver(handler.PollutantTopic, other)
+	if published := remote.Published(handler.PollutantTopic); len(published) != 0 {
+		t.Fatalf("Expect invalid sample not forwarded, got %v", published)
+	}
+	if records, _ := store.Find(Filter{Table: PollutantTable, EndDate: ts + 10}); len(records) != 0 {
+		t.Fatalf("Expect invalid sample not saved, got %v", records)
+	}
+
+	var letters []DeadLetter
+	if code := apiRequest(t, handler, http.MethodGet, "/deadletters", "", &letters); code != http.StatusOK {
+		t.Fatalf("Unexpected dead letters code %v", code)
+	}
+	if len(letters) != 1 || letters[0].Table != PollutantTable || letters[0].Topic != handler.PollutantTopic || string(letters[0].Data) != string(other) {
+		t.Fatalf("Expect the message quarantined as received, got %+v", letters)
+	}
+	if letters[0].Reason != "DeviceID AirSENCE-Other does not match ClientID AirSENCE-Dummy" {
+		t.Fatalf("Unexpected reason:%v", letters[0].Reason)
+	}
+}
+
+func TestNotQuarantineIgnoredData(t *testing.T) {
+	handler, local, remote, store := newTestHandler(t)
+	handler.config.Server.SendRawData = false
+	handler.config.Server.LogRaw = false
+	local.Deliver(handler.RawTopic, []byte{0xc1})
+	if published := remote.Published(handler.RawTopic); len(published) != 0 {
+		t.Fatalf("Expect raw data not forwarded, got %v", published)
+	}
+	if letters, _ := store.DeadLetters(0, time.Now().Unix(), 0); len(letters) != 0 {
+		t.Fatalf("Expect raw data neither sent nor saved not quarantined, got %+v", letters)
+	}
+	if snapshot := handler.metricsSnapshot(); snapshot.Received[RawTable] != 1 || snapshot.Quarantined[RawTable] != 0 {
+		t.Fatalf("Expect raw data counted as received only, got %+v", snapshot)
+	}
+}
+
+func TestQuarantineUntilDatabaseReady(t *testing.T) {
+	handler, local, _, store := newTestHandler(t)
+	handler.SetStore(nil)
+	//Hold the opening, as if the clock is not synchronized yet
+	if !handler.db.startOpening() {
+		t.Fatal("Expect database to be opened")
+	}
+	local.Deliver(handler.RawTopic, []byte{0xc1})
+	if handler.db.Buffered() != 1 {
+		t.Fatalf("Expect the invalid message buffered, got %v", handler.db.Buffered())
+	}
+	handler.storeOpened(store)
+	letters, _ := store.DeadLetters(0, time.Now().Unix(), 0)
+	if len(letters) != 1 || letters[0].Table != RawTable || string(letters[0].Data) != string([]byte{0xc1}) {
+		t.Fatalf("Expect the buffered message quarantined once the database is ready, got %+v", letters)
+	}
+	if records, _ := store.Find(Filter{Table: RawTable, EndDate: time.Now().Unix()}); len(records) != 0 {
+		t.Fatalf("Expect no sample saved, got %v", records)
+	}
+}
+
+func TestSQLiteStoreDeadLetters(t *testing.T) {
+	store, err := NewSQLiteStore(t.TempDir(), "AirSENCE-Dummy", []string{"cloud"}, testLogger(), time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	march := time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC).Unix()
+	april := time.Date(2022, 4, 15, 0, 0, 0, 0, time.UTC).Unix()
+	for _, received := range []int64{april, march} {
+		letter := DeadLetter{Received: received, Table: RawTable, Topic: "airsence/AUG/AirSENCE-Dummy/raw", Reason: "RawData is missing", Data: []byte{0x80}}
+		if err = store.Quarantine(letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	letters, err := store.DeadLetters(0, april, 0)
+	if err != nil || len(letters) != 2 || letters[0].Received != march || letters[1].Partition != "AirSENCE-Dummy_202204.db" {
+		t.Fatalf("Expect dead letters of every month in order, got %+v (%v)", letters, err)
+	}
+	if letters[0].Reason != "RawData is missing" || len(letters[0].Data) != 1 {
+		t.Fatalf("Unexpected dead letter:%+v", letters[0])
+	}
+	if limited, _ := store.DeadLetters(0, april, 1); len(limited) != 1 {
+		t.Fatalf("Expect 1 dead letter with limit, got %v", limited)
+	}
+	if _, err = store.Purge(april); err != nil {
+		t.Fatal(err)
+	}
+	if letters, _ = store.DeadLetters(0, april, 0); len(letters) != 1 || letters[0].Received != april {
+		t.Fatalf("Expect old dead letters purged, got %+v", letters)
+	}
+}
@@ -137,11 +137,13 @@ func main() {
 	/** Gracefull shutdow setup **/
 	// Initialize two channel for gracefully shutdown
 	stopSignal := make(chan bool, 1)
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	// Notify quit if os send a close signal
 	signal.Notify(quit, os.Interrupt, os.Kill, syscall.SIGKILL, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	//Setup gracefull shutdown routine
 	go gracefullShutdown(quit, stopSignal, mainLogger)
+	handler.Version = Version
+	handler.UserConfigPath = USERCONFIGPATH
 	myHandler := handler.InitHandler(CONFIG, stopSignal, mainLogger)
 	myHandler.Run()
 	mainLogger.Infoln("Service shut down.")
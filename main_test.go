@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
 
@@ -15,6 +16,9 @@ import (
 
 func TestSqlite(t *testing.T) {
 	// os.Remove("./foo.db")
+	if _, err := os.Stat("./AirSENCE-Dummy_202104.db"); err != nil {
+		t.Skip("No database file to inspect")
+	}
 	var sqlStmt string
 	db, err := sql.Open("sqlite3", "./AirSENCE-Dummy_202104.db?cache=shared&mode=rwc&_journal_mode=WAL")
 	if err != nil {
@@ -94,9 +98,15 @@ func TestSqlite(t *testing.T) {
 	}
 }
 
+//TestSending keeps publishing dummy pollutant data to a live local MQTT broker.
+//It only runs when DATASYNC_LOCAL_BROKER is set, e.g. DATASYNC_LOCAL_BROKER=127.0.0.1:1883
 func TestSending(t *testing.T) {
+	broker := os.Getenv("DATASYNC_LOCAL_BROKER")
+	if broker == "" {
+		t.Skip("DATASYNC_LOCAL_BROKER not set, handler flows are covered offline in handler package")
+	}
 	optionsLocal := mqtt.NewClientOptions()
-	optionsLocal.AddBroker("127.0.0.1:1883")
+	optionsLocal.AddBroker(broker)
 	optionsLocal.SetClientID("Dummy" + "_DataSync")
 	// optionsLocal.SetConnectionLostHandler(handler.lostConnectionHandlerLo)
 	// optionsLocal.SetOnConnectHandler(handler.onConnectionHandlerLo)